@@ -0,0 +1,239 @@
+package adslproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AccessLogEntry records a connection proxied through a forward
+type AccessLogEntry struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Consumer string    `json:"consumer,omitempty"`
+	NodeId   string    `json:"node_id"`
+	ExitIp   string    `json:"exit_ip,omitempty"`
+	Forward  string    `json:"forward"`
+	// Target is the host requested by http or socks5, if it can be parsed
+	Target    string `json:"target,omitempty"`
+	BytesUp   int64  `json:"bytes_up"`
+	BytesDown int64  `json:"bytes_down"`
+	// Duration is in milliseconds
+	Duration int64  `json:"duration"`
+	Reason   string `json:"reason"`
+}
+
+// AccessLog writes entries as json lines. The file is rotated when it is
+// larger than MaxSize, and at most MaxBackups rotated files are kept.
+type AccessLog struct {
+	MaxSize    int64
+	MaxBackups int
+
+	path string
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+func NewAccessLog(path string, maxSize int64, maxBackups int) (*AccessLog, error) {
+	l := &AccessLog{
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+		path:       path,
+	}
+
+	return l, l.open()
+}
+
+func (l *AccessLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.WithStack(err)
+	}
+
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// rotate renames path to path.1, path.1 to path.2 and so on, must be called with the lock held
+func (l *AccessLog) rotate() error {
+	l.file.Close()
+
+	for i := l.MaxBackups; i > 0; i-- {
+		from := l.path
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", l.path, i-1)
+		}
+
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", l.path, i)); err != nil && !os.IsNotExist(err) {
+			glog.Errorf("failed to rotate access log %s", err)
+		}
+	}
+
+	if l.MaxBackups <= 0 {
+		os.Remove(l.path)
+	}
+
+	return l.open()
+}
+
+// Log writes the entry, a nil AccessLog discards it
+func (l *AccessLog) Log(e *AccessLogEntry) {
+	if l == nil {
+		return
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		glog.Errorf("failed to marshal access log %s", err)
+		return
+	}
+	data = append(data, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file == nil {
+		return
+	}
+
+	if l.MaxSize > 0 && l.size+int64(len(data)) > l.MaxSize {
+		if err := l.rotate(); err != nil {
+			glog.Errorf("failed to reopen access log %s", err)
+			return
+		}
+	}
+
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		glog.Errorf("failed to write access log %s", err)
+	}
+}
+
+func (l *AccessLog) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// finish fills the bytes and duration of the entry and logs it
+func (l *AccessLog) finish(e *AccessLogEntry, m *meter) {
+	if l == nil {
+		return
+	}
+
+	e.BytesUp, e.BytesDown = m.counts()
+	e.Duration = int64(time.Since(e.Time) / time.Millisecond)
+	l.Log(e)
+}
+
+// sniffLimit is the max bytes from a client which are parsed for the target
+const sniffLimit = 4096
+
+// targetSniffer finds the target of a proxy request in the first bytes from
+// a client which is not authenticated by the server, while they are proxied
+type targetSniffer struct {
+	io.ReadWriter
+
+	lock   sync.Mutex
+	head   []byte
+	done   bool
+	target string
+}
+
+func (ts *targetSniffer) Read(b []byte) (int, error) {
+	n, err := ts.ReadWriter.Read(b)
+	if n > 0 {
+		ts.lock.Lock()
+		if !ts.done {
+			ts.head = append(ts.head, b[:n]...)
+			ts.target, ts.done = sniffTarget(ts.head)
+			if ts.done || len(ts.head) >= sniffLimit {
+				ts.done = true
+				ts.head = nil
+			}
+		}
+		ts.lock.Unlock()
+	}
+
+	return n, err
+}
+
+// Target returns the target found so far
+func (ts *targetSniffer) Target() string {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	return ts.target
+}
+
+// sniffTarget parses an http request or a socks5 handshake, done is false if
+// more bytes are needed
+func sniffTarget(head []byte) (target string, done bool) {
+	if head[0] == socks5Version {
+		return sniffSocks5Target(head)
+	}
+
+	if !bytes.Contains(head, []byte("\r\n\r\n")) {
+		return "", false
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+	if err != nil {
+		return "", true
+	}
+
+	return req.Host, true
+}
+
+// sniffSocks5Target skips the methods and the username/password of the
+// client, then parses its request
+func sniffSocks5Target(head []byte) (string, bool) {
+	if len(head) < 2 || len(head) < 2+int(head[1]) {
+		return "", false
+	}
+	pos := 2 + int(head[1])
+
+	if len(head) > pos && head[pos] == socks5UserPassVersion {
+		// version, username and password
+		if len(head) < pos+2 || len(head) < pos+2+int(head[pos+1])+1 {
+			return "", false
+		}
+		pos += 2 + int(head[pos+1])
+		pos += 1 + int(head[pos])
+		if len(head) < pos {
+			return "", false
+		}
+	}
+
+	request, err := readSocks5Request(bufio.NewReader(bytes.NewReader(head[pos:])))
+	if err != nil {
+		cause := errors.Cause(err)
+		return "", cause != io.EOF && cause != io.ErrUnexpectedEOF
+	}
+
+	return socks5Target(request), true
+}
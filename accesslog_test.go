@@ -0,0 +1,102 @@
+package adslproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSniffTarget(t *testing.T) {
+	socks5Request := []byte{socks5Version, 1, 0, socks5AtypDomain, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0x01, 0xbb}
+	socks5Auth := []byte{socks5UserPassVersion, 1, 'u', 2, 'p', 'w'}
+
+	cases := []struct {
+		head   []byte
+		target string
+		done   bool
+	}{
+		{[]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"), "example.com:443", true},
+		{[]byte("GET http://example.com/a HTTP/1.1\r\nHost: example.com\r\n\r\n"), "example.com", true},
+		{[]byte("GET /a HTTP/1.1\r\nHost: example.org\r\n\r\n"), "example.org", true},
+		{[]byte("GET /a HTTP/1.1\r\nHost: exa"), "", false},
+		{[]byte("SSH-2.0-OpenSSH\r\n\r\n"), "", true},
+		{append([]byte{socks5Version, 1, socks5AuthNone}, socks5Request...), "example.com:443", true},
+		{append(append([]byte{socks5Version, 1, socks5AuthUserPass}, socks5Auth...), socks5Request...), "example.com:443", true},
+		{[]byte{socks5Version, 1, socks5AuthNone}, "", false},
+		{append([]byte{socks5Version, 1, socks5AuthUserPass}, socks5Auth[:3]...), "", false},
+		{append([]byte{socks5Version, 1, socks5AuthNone}, socks5Request[:8]...), "", false},
+	}
+
+	for _, c := range cases {
+		target, done := sniffTarget(c.head)
+		if target != c.target || done != c.done {
+			t.Errorf("%q is sniffed as %s %v", c.head, target, done)
+		}
+	}
+}
+
+func TestTargetSniffer(t *testing.T) {
+	request := "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\nrest"
+	sniffer := &targetSniffer{ReadWriter: bytes.NewBufferString(request)}
+
+	// the request is read in small chunks
+	b := make([]byte, 7)
+	var read []byte
+	for {
+		n, err := sniffer.Read(b)
+		read = append(read, b[:n]...)
+		if err != nil {
+			break
+		}
+	}
+
+	if string(read) != request {
+		t.Errorf("sniffer changes the data %q", read)
+	}
+
+	if sniffer.Target() != "example.com:443" {
+		t.Errorf("target %s", sniffer.Target())
+	}
+
+	// a client which never sends a request stops being parsed
+	sniffer = &targetSniffer{ReadWriter: bytes.NewBufferString(strings.Repeat("x", 2*sniffLimit))}
+	ioutil.ReadAll(sniffer)
+	if sniffer.Target() != "" || !sniffer.done || sniffer.head != nil {
+		t.Errorf("sniffer is not finished")
+	}
+}
+
+func TestAccessLogRotate(t *testing.T) {
+	path := filepath.Join(filepath.Dir(writeTempFile(t, "empty", "")), "access.log")
+	l, err := NewAccessLog(path, 200, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		l.Log(&AccessLogEntry{Client: "127.0.0.1:40000", Forward: "http", Target: "example.com:443"})
+	}
+	l.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entry AccessLogEntry
+	if err := json.Unmarshal(bytes.Split(data, []byte("\n"))[0], &entry); err != nil || entry.Target != "example.com:443" {
+		t.Errorf("entry %+v %v", entry, err)
+	}
+
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Errorf("access log is not rotated %s", err)
+	}
+
+	if _, err := os.Stat(path + ".2"); err == nil {
+		t.Error("more backups than MaxBackups are kept")
+	}
+}
@@ -0,0 +1,206 @@
+package adslproxy
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net"
+	"sync"
+)
+
+// accessListFile is the format of the file which AccessList is loaded from
+//
+//	{
+//	  "allow": ["10.0.0.0/8"],
+//	  "labels": {"office": ["192.168.1.0/24"]}
+//	}
+type accessListFile struct {
+	Allow  []string            `json:"allow"`
+	Labels map[string][]string `json:"labels"`
+}
+
+// AccessList holds the CIDR allowlists of clients connecting to the forward
+// ports. A client is allowed if its address is in the server list or in the
+// list of any label of the node. Everyone is allowed if none of them is set.
+// The labels of nodes are assigned by server, see Server.NodeLabels.
+type AccessList struct {
+	path string
+
+	lock   sync.RWMutex
+	allow  []*net.IPNet
+	labels map[string][]*net.IPNet
+
+	deniedLock sync.Mutex
+	denied     map[string]uint64
+}
+
+func NewAccessList(path string) (*AccessList, error) {
+	a := &AccessList{
+		path:   path,
+		denied: make(map[string]uint64),
+	}
+
+	return a, a.Reload()
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+// Reload reads the allowlists from the file again, the current lists are kept if it fails
+func (a *AccessList) Reload() error {
+	data, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var file accessListFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return errors.Wrapf(err, "failed to parse access list %s", a.path)
+	}
+
+	allow, err := parseCIDRs(file.Allow)
+	if err != nil {
+		return err
+	}
+
+	labels := make(map[string][]*net.IPNet)
+	for label, cidrs := range file.Labels {
+		if labels[label], err = parseCIDRs(cidrs); err != nil {
+			return err
+		}
+	}
+
+	a.lock.Lock()
+	a.allow = allow
+	a.labels = labels
+	a.lock.Unlock()
+
+	glog.Infof("access list is loaded from %s", a.path)
+	return nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Admits checks the client before the node is known. It is denied only if
+// the server list is set and the client is in none of the lists, then it is
+// denied by any node. A nil AccessList admits everyone.
+func (a *AccessList) Admits(client net.Addr) bool {
+	return a.check(client, nil, true)
+}
+
+// Allowed checks if the client may connect to the forwards of the node. A
+// nil AccessList allows everyone.
+func (a *AccessList) Allowed(client net.Addr, node *Node) bool {
+	return a.check(client, node.Labels(), false)
+}
+
+// check matches the client against the server list and the lists of the
+// labels, or the lists of all labels if anyLabel is true
+func (a *AccessList) check(client net.Addr, labels []string, anyLabel bool) bool {
+	if a == nil {
+		return true
+	}
+
+	tcpAddr, ok := client.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	restricted := len(a.allow) > 0
+	if containsIP(a.allow, tcpAddr.IP) {
+		return true
+	}
+
+	for label, nets := range a.labels {
+		if !anyLabel && !containsString(labels, label) {
+			continue
+		}
+
+		if !anyLabel {
+			restricted = true
+		}
+
+		if containsIP(nets, tcpAddr.IP) {
+			return true
+		}
+	}
+
+	if !restricted {
+		return true
+	}
+
+	a.deniedLock.Lock()
+	a.denied[tcpAddr.IP.String()]++
+	a.deniedLock.Unlock()
+	return false
+}
+
+// LoadNodeLabels reads the labels of nodes by name from a json file, e.g.
+// {"node-1": ["office"]}
+func LoadNodeLabels(path string) (map[string][]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var labels map[string][]string
+	if err := json.Unmarshal(data, &labels); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse node labels %s", path)
+	}
+
+	return labels, nil
+}
+
+// Denied returns the number of denied connections by client IP
+func (a *AccessList) Denied() map[string]uint64 {
+	a.deniedLock.Lock()
+	defer a.deniedLock.Unlock()
+
+	denied := make(map[string]uint64, len(a.denied))
+	for ip, count := range a.denied {
+		denied[ip] = count
+	}
+
+	return denied
+}
+
+// rules returns the allowlists in the format of the file
+func (a *AccessList) rules() accessListFile {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	rules := accessListFile{Labels: make(map[string][]string)}
+	for _, ipNet := range a.allow {
+		rules.Allow = append(rules.Allow, ipNet.String())
+	}
+
+	for label, nets := range a.labels {
+		for _, ipNet := range nets {
+			rules.Labels[label] = append(rules.Labels[label], ipNet.String())
+		}
+	}
+
+	return rules
+}
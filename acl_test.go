@@ -0,0 +1,133 @@
+package adslproxy
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAccessList(t *testing.T) {
+	path := writeTempFile(t, "acl.json", `{
+		"allow": ["10.0.0.0/8"],
+		"labels": {"office": ["192.168.1.0/24"]}
+	}`)
+
+	acl, err := NewAccessList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	office, _ := newTestNode("office")
+	office.setLabels([]string{"office"})
+	plain, _ := newTestNode("plain")
+
+	cases := []struct {
+		client  string
+		node    *Node
+		allowed bool
+	}{
+		{"10.1.2.3", plain, true},
+		{"10.1.2.3", office, true},
+		{"192.168.1.5", office, true},
+		{"192.168.1.5", plain, false},
+		{"172.16.0.1", office, false},
+	}
+
+	for _, c := range cases {
+		if acl.Allowed(tcpAddr(c.client), c.node) != c.allowed {
+			t.Errorf("%s to %s allowed %v", c.client, c.node.Id, !c.allowed)
+		}
+	}
+
+	if !acl.Admits(tcpAddr("192.168.1.5")) || !acl.Admits(tcpAddr("10.0.0.1")) {
+		t.Error("a client allowed on some node is not admitted")
+	}
+
+	if acl.Admits(tcpAddr("172.16.0.1")) {
+		t.Error("a client in none of the lists is admitted")
+	}
+
+	if denied := acl.Denied()["172.16.0.1"]; denied != 2 {
+		t.Errorf("denied %d times", denied)
+	}
+
+	ioutil.WriteFile(path, []byte(`{"allow": ["172.16.0.0/12"]}`), 0600)
+	if err := acl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !acl.Allowed(tcpAddr("172.16.0.1"), plain) || acl.Allowed(tcpAddr("10.1.2.3"), plain) {
+		t.Error("access list is not reloaded")
+	}
+}
+
+func TestAccessListLabelsOnly(t *testing.T) {
+	acl, err := NewAccessList(writeTempFile(t, "acl.json", `{"labels": {"office": ["192.168.1.0/24"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	office, _ := newTestNode("office")
+	office.setLabels([]string{"office"})
+	plain, _ := newTestNode("plain")
+
+	// a node without labels of the lists is not restricted
+	if !acl.Admits(tcpAddr("172.16.0.1")) || !acl.Allowed(tcpAddr("172.16.0.1"), plain) {
+		t.Error("client of an unrestricted node is denied")
+	}
+
+	if acl.Allowed(tcpAddr("172.16.0.1"), office) {
+		t.Error("client out of the label list is allowed")
+	}
+}
+
+func TestNilAccessList(t *testing.T) {
+	var acl *AccessList
+	if !acl.Admits(tcpAddr("1.2.3.4")) || !acl.Allowed(tcpAddr("1.2.3.4"), &Node{}) {
+		t.Error("nil access list denies")
+	}
+}
+
+func TestDeniedClientDoesNotWaitForHeldPort(t *testing.T) {
+	acl, err := NewAccessList(writeTempFile(t, "acl.json", `{"allow": ["10.0.0.0/8"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServer()
+	s.AccessList = acl
+	s.HoldPeriod = time.Minute
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// the port is held, nothing is bound to it
+	p := newForwardPort(l, "a", "http")
+	go s.servePort(p, l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("denied client is not closed at once %v", err)
+	}
+}
+
+func TestLoadNodeLabels(t *testing.T) {
+	labels, err := LoadNodeLabels(writeTempFile(t, "labels.json", `{"a": ["office", "fast"]}`))
+	if err != nil || len(labels["a"]) != 2 {
+		t.Errorf("labels %v %v", labels, err)
+	}
+
+	if _, err := LoadNodeLabels(writeTempFile(t, "labels.json", `[]`)); err == nil {
+		t.Error("illegal labels are loaded")
+	}
+}
@@ -1,14 +1,15 @@
 package adslproxy
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/gocloudio/crypto/ssh"
 	"github.com/golang/glog"
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
-	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"sync"
 	"time"
 
@@ -20,7 +21,7 @@ import (
 type Agent struct {
 	sshConfig   *ssh.ClientConfig
 	ForwardList []*Forward
-	serverAddr  *net.TCPAddr
+	serverAddr  string
 	stopper     chan bool
 
 	id         string
@@ -32,6 +33,44 @@ type Agent struct {
 	socksProxyListener net.Listener
 	proxyCredential    *ProxyCredential
 	httpProxyServer    *http.Server
+
+	// Labels are declared to server, which only keeps the labels it assigns to the node
+	Labels []string
+	// AccessLog records the connections from server, nothing is recorded if nil
+	AccessLog *AccessLog
+	// throttle holds the limits pushed by server
+	throttle *Throttle
+	// redialReport is sent to server after reconnecting from a redial
+	redialReport *RedialReportMsg
+	disconnected time.Time
+	// reconnectRequest is set by the request handler when server asks for a
+	// redial, and taken by Reconnect
+	reconnectLock    sync.Mutex
+	reconnectRequest *ReconnectMsg
+
+	// ConnectBackoff delays the connections to server after failures, apart from the redial retries
+	ConnectBackoff *Backoff
+	statusLock     sync.Mutex
+	status         AgentStatus
+
+	// Servers are tried by ServerPolicy on connecting, the server given to
+	// NewAgent is used if empty
+	Servers      []ServerEndpoint
+	ServerPolicy string
+	// UpstreamProxy is an http or socks5 proxy which server is connected through, see ParseUpstreamProxy
+	UpstreamProxy *url.URL
+}
+
+// AgentStatus is the state of the connection to server
+type AgentStatus struct {
+	Connected   bool      `json:"connected"`
+	ConnectedAt time.Time `json:"connected_at"`
+	// ConnectFailures is the number of failed connections since the last success
+	ConnectFailures int       `json:"connect_failures"`
+	NextConnect     time.Time `json:"next_connect"`
+	LastError       string    `json:"last_error,omitempty"`
+	LastRedial      time.Time `json:"last_redial"`
+	Server          string    `json:"server"`
 }
 
 func NewForward(name, left, right, options string) (*Forward, error) {
@@ -46,7 +85,7 @@ func NewForward(name, left, right, options string) (*Forward, error) {
 
 func NewAgent(
 	user, password string,
-	serverAddr *net.TCPAddr,
+	serverAddr string,
 	adslConfig *AdslConfig,
 	proxyCredential *ProxyCredential,
 	forwards ...*Forward,
@@ -62,21 +101,96 @@ func NewAgent(
 	}
 
 	return &Agent{
+		id:              id,
+		throttle:        NewThrottle(),
+		user:            user,
 		sshConfig:       config,
 		ForwardList:     forwards,
 		serverAddr:      serverAddr,
 		adslConfig:      adslConfig,
 		proxyCredential: proxyCredential,
+		ConnectBackoff:  NewBackoff(DefaultBackoffMin, DefaultBackoffMax),
+	}
+}
+
+func (a *Agent) Status() AgentStatus {
+	a.statusLock.Lock()
+	defer a.statusLock.Unlock()
+
+	return a.status
+}
+
+func (a *Agent) updateStatus(update func(status *AgentStatus)) {
+	a.statusLock.Lock()
+	defer a.statusLock.Unlock()
+
+	update(&a.status)
+}
+
+// Run keeps the agent connected to server. A failed connection is retried
+// with backoff, even if the line is redialed, so a server which is down is
+// not hammered by the agents.
+func (a *Agent) Run() {
+	for {
+		err := a.Start()
+		a.Reconnect()
+
+		time.Sleep(a.connectDelay(err))
+	}
+}
+
+// connectDelay returns the delay before connecting again after Start
+// returns err, the backoff is reset only after a session was established
+func (a *Agent) connectDelay(err error) time.Duration {
+	if err == nil {
+		a.ConnectBackoff.Reset()
+		return 0
 	}
+
+	delay := a.ConnectBackoff.Next()
+	glog.Errorf("failed to connect to server %d times, retry in %s", a.ConnectBackoff.Attempts(), delay)
+	a.updateStatus(func(status *AgentStatus) {
+		status.ConnectFailures = a.ConnectBackoff.Attempts()
+		status.NextConnect = time.Now().Add(delay)
+		status.LastError = err.Error()
+	})
+
+	return delay
 }
 
 func (a *Agent) Stop() {
 	close(a.stopper)
 }
 
+// Dial connects to the first reachable server in the order of ServerPolicy
 func (a *Agent) Dial() (*ssh.Client, error) {
-	addr := a.serverAddr.String()
-	conn, err := net.DialTimeout("tcp", addr, a.sshConfig.Timeout)
+	var lastErr error
+	for _, server := range a.serverOrder() {
+		client, err := a.dialServer(server.Addr)
+		if err == nil {
+			a.serverAddr = server.Addr
+			return client, nil
+		}
+
+		glog.Errorf("failed to connect to %s %s", server.Addr, err)
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+// dial connects to addr through the upstream proxy if there is one, which
+// resolves the host of addr then
+func (a *Agent) dial(addr string) (net.Conn, error) {
+	if a.UpstreamProxy != nil {
+		return dialUpstream(a.UpstreamProxy, addr, a.sshConfig.Timeout)
+	}
+
+	return net.DialTimeout("tcp", addr, a.sshConfig.Timeout)
+}
+
+func (a *Agent) dialServer(addr string) (*ssh.Client, error) {
+	conn, err := a.dial(addr)
 	if err != nil {
 		return nil, err
 	}
@@ -104,9 +218,31 @@ func (a *Agent) SshRequestHandler(c ssh.Conn, reqs <-chan *ssh.Request) {
 	for req := range reqs {
 		switch req.Type {
 		case Reconnect:
+			msg := ReconnectMsg{Reason: RedialReasonRequested}
+			if len(req.Payload) > 0 {
+				if err := json.Unmarshal(req.Payload, &msg); err != nil {
+					glog.Errorf("illegal reconnect request from server %s", err)
+				}
+			}
+
+			a.reconnectLock.Lock()
+			a.reconnectRequest = &msg
+			a.reconnectLock.Unlock()
+
 			req.Reply(true, nil)
 			c.Close()
 			return
+		case ThrottleLimits:
+			var limits map[string]RateLimit
+			if err := json.Unmarshal(req.Payload, &limits); err != nil {
+				glog.Errorf("illegal limits from server %s", err)
+				req.Reply(false, nil)
+				continue
+			}
+
+			a.throttle.Replace(limits)
+			glog.V(2).Infof("limits are updated %v", limits)
+			req.Reply(true, nil)
 		default:
 			req.Reply(true, nil)
 		}
@@ -176,16 +312,45 @@ func (a *Agent) Start() error {
 	}
 
 	client, err := a.Dial()
-
 	if err != nil {
-		glog.Errorf("failed to connect to %s %s", a.serverAddr.String(), err)
 		return errors.WithStack(err)
 	}
 
-	glog.Infof("connected to %s", a.serverAddr.String())
+	glog.Infof("connected to %s", a.serverAddr)
+
+	done := make(chan bool)
+	defer close(done)
+	go a.watchPrimary(client, done)
+
+	a.updateStatus(func(status *AgentStatus) {
+		status.Server = a.serverAddr
+		status.Connected = true
+		status.ConnectedAt = time.Now()
+		status.ConnectFailures = 0
+		status.NextConnect = time.Time{}
+	})
+	defer a.updateStatus(func(status *AgentStatus) {
+		status.Connected = false
+	})
+
+	if a.redialReport != nil {
+		a.redialReport.Offline = int64(time.Since(a.disconnected) / time.Millisecond)
+		payload, _ := json.Marshal(a.redialReport)
+		if _, _, err := client.SendRequest(RedialReport, false, payload); err != nil {
+			glog.Errorf("failed to send redial report to %s %s", a.serverAddr, err)
+		}
+		a.redialReport = nil
+	}
+
+	if len(a.Labels) > 0 {
+		payload, _ := json.Marshal(a.Labels)
+		if ok, _, err := client.SendRequest(NodeLabels, true, payload); !ok || err != nil {
+			glog.Errorf("failed to send labels to %s %v", a.serverAddr, err)
+		}
+	}
 
+	// errc is never closed since the tunnels may still be closing when Start returns
 	errc := make(chan bool, len(forwardList))
-	defer close(errc)
 
 	go func() {
 		select {
@@ -193,6 +358,7 @@ func (a *Agent) Start() error {
 			client.Close()
 		case <-errc:
 			client.Close()
+		case <-done:
 		}
 	}()
 
@@ -215,22 +381,19 @@ func (a *Agent) Start() error {
 		}
 	}()
 
+	forwards, listeners := createTunnels(client, forwardList)
+	if len(listeners) == 0 {
+		client.Close()
+		return errors.Errorf("no forward is accepted by %s", a.serverAddr)
+	}
+
 	wg := sync.WaitGroup{}
-	wg.Add(len(forwardList))
+	wg.Add(len(listeners))
 
 	am := newActiveConnManager()
 	defer am.clear()
 
-	for _, forward := range forwardList {
-		listener, err := client.CreateTunnel(forward.Left, forward.Right, forward.Name, forward.Options)
-		if err != nil {
-			glog.Errorf("failed to listen to server port %s %s", forward.Right, err)
-			return err
-		}
-
-		// fix when port is 0
-		forward.Left = listener.Addr().(*net.TCPAddr)
-
+	for i, forward := range forwards {
 		go func(t *Forward, l net.Listener) {
 			defer func() {
 				wg.Done()
@@ -253,10 +416,23 @@ func (a *Agent) Start() error {
 					defer am.remove(remote)
 					defer remote.Close()
 
+					m := &meter{ReadWriter: remote}
+					entry := &AccessLogEntry{
+						Time:    time.Now(),
+						Client:  remote.RemoteAddr().String(),
+						NodeId:  a.id,
+						Forward: t.Name,
+					}
+					defer a.AccessLog.finish(entry, m)
+
 					// Open a (local) connection to localEndpoint whose content will be forwarded so serverEndpoint
 					local, err := net.Dial("tcp", t.Right)
 					if err != nil {
 						glog.Errorf("failed to connect to service %s %s", t.Right, err)
+						entry.Reason = "failed to connect to service " + err.Error()
+
+						payload, _ := json.Marshal(DialErrorMsg{Forward: t.Name, Error: err.Error()})
+						client.SendRequest(DialError, false, payload)
 						return
 					}
 
@@ -264,26 +440,12 @@ func (a *Agent) Start() error {
 					defer am.remove(local)
 					defer local.Close()
 
-					chDone := make(chan bool, 1)
-
-					pipe := func(to io.WriteCloser, from io.ReadCloser) {
-						// if either end breaks, close both ends to ensure they're both unblocked,
-						// otherwise io.Copy can block forever if e.g. reading after write end has
-						// gone away
-						defer func() {
-							chDone <- true
-						}()
-
-						_, _ = io.Copy(to, from)
-					}
-
-					go pipe(remote, local)
-					go pipe(local, remote)
+					scopes := append(a.throttle.labelScopes(), [2]string{ScopeForward + t.Name, ScopeForward + t.Name})
 
-					<-chDone
+					entry.Reason = closeReason(pipe(a.throttle.wrap(m, scopes...), local))
 				}()
 			}
-		}(forward, listener)
+		}(forward, listeners[i])
 	}
 
 	wg.Wait()
@@ -291,19 +453,116 @@ func (a *Agent) Start() error {
 	return nil
 }
 
-func (a *Agent) Reconnect() {
-	if a.adslConfig != nil {
-		for {
-			err := a.adslConfig.Redial()
-			if err != nil {
-				glog.Errorf("failed to redial %s", err)
-				time.Sleep(a.adslConfig.RedialInterval)
-				continue
-			}
+// tunnelCreator creates tunnels of forwards on server, it is ssh.Client
+type tunnelCreator interface {
+	CreateTunnel(left *net.TCPAddr, right, name, options string) (net.Listener, error)
+}
+
+// createTunnels creates the tunnels of the forwards and returns the forwards
+// accepted by server with their listeners. Rejected forwards are skipped so
+// that the session is kept for the others.
+func createTunnels(client tunnelCreator, forwardList []*Forward) ([]*Forward, []net.Listener) {
+	var forwards []*Forward
+	var listeners []net.Listener
+	for _, forward := range forwardList {
+		listener, err := client.CreateTunnel(forward.Left, forward.Right, forward.Name, forward.Options)
+		if err != nil {
+			glog.Errorf("failed to listen to server port %s %s", forward.Right, err)
+			continue
+		}
+
+		// fix when port is 0
+		forward.Left = listener.Addr().(*net.TCPAddr)
+		forwards = append(forwards, forward)
+		listeners = append(listeners, listener)
+	}
+
+	return forwards, listeners
+}
+
+// Reconnect is called when the session to server is closed. The line is
+// redialed only if server asks for it or the connectivity is lost, and not
+// redialed again for a lost line if another agent sharing it has redialed it
+// since the session is closed. True is returned if it is redialed.
+func (a *Agent) Reconnect() bool {
+	if a.redialReport == nil {
+		a.disconnected = time.Now()
+	}
+
+	a.reconnectLock.Lock()
+	req := a.reconnectRequest
+	a.reconnectRequest = nil
+	a.reconnectLock.Unlock()
+
+	if a.adslConfig == nil {
+		return false
+	}
+
+	if req != nil {
+		time.Sleep(time.Duration(req.Delay) * time.Millisecond)
+	}
+
+	// agents registered with several servers share the line, the connectivity
+	// is checked after the redial of another agent
+	a.adslConfig.redialLock.Lock()
+	defer a.adslConfig.redialLock.Unlock()
 
-			break
+	if req == nil && a.adslConfig.redialedBy != a.id && a.adslConfig.lastRedial.After(a.disconnected) {
+		glog.Infof("line is redialed by another agent at %s since the session is closed, reconnect without redial", a.adslConfig.lastRedial)
+		return false
+	}
+
+	var reason string
+	if req != nil {
+		reason = req.Reason
+		lastRedial := a.adslConfig.lastRedial
+		if !req.Force && time.Since(lastRedial) < a.adslConfig.MinRedialInterval {
+			glog.Infof("redial requested by server is skipped, the line is redialed at %s", lastRedial)
+			return false
+		}
+	} else if a.connectivityLost() {
+		reason = RedialReasonLost
+	} else {
+		glog.Infof("session to server is closed while the line is up, reconnect without redial")
+		return false
+	}
+
+	glog.Infof("redial for %s", reason)
+	report := &RedialReportMsg{
+		Reason:   reason,
+		Attempts: a.adslConfig.RedialVerified(),
+	}
+	a.adslConfig.lastRedial = time.Now()
+	a.adslConfig.redialedBy = a.id
+	a.updateStatus(func(status *AgentStatus) {
+		status.LastRedial = a.adslConfig.lastRedial
+	})
+
+	// the ips are from ip echo, they are empty if it is not checked
+	report.PreviousIp = report.Attempts[0].PreviousIp
+	report.Ip = report.Attempts[len(report.Attempts)-1].Ip
+	a.redialReport = report
+	return true
+}
+
+// connectivityLost checks the line with the ip echo or CheckAddr of the adsl
+// config. If neither is set, the line is not checked and never taken as lost,
+// a server which is unreachable doesn't mean the line is down.
+func (a *Agent) connectivityLost() bool {
+	switch {
+	case a.adslConfig.IpEchoUrl != "":
+		_, err := a.adslConfig.ExitIp()
+		return err != nil
+	case a.adslConfig.CheckAddr != "":
+		conn, err := net.DialTimeout("tcp", a.adslConfig.CheckAddr, ClientConnectTimeout)
+		if err != nil {
+			return true
 		}
+
+		conn.Close()
 	}
+
+	return false
 }
 func (a *Agent) StartHttpProxy() *net.TCPAddr {
 	l, err := net.Listen("tcp", "localhost:0")
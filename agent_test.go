@@ -0,0 +1,125 @@
+package adslproxy
+
+import (
+	"encoding/json"
+	"github.com/gocloudio/crypto/ssh"
+	"github.com/pkg/errors"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConnectivityLost(t *testing.T) {
+	a := &Agent{adslConfig: &AdslConfig{}}
+	if a.connectivityLost() {
+		t.Error("line is taken as lost without a check")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.adslConfig.CheckAddr = l.Addr().String()
+	if a.connectivityLost() {
+		t.Error("line is lost while CheckAddr is reachable")
+	}
+
+	l.Close()
+	if !a.connectivityLost() {
+		t.Error("line is up while CheckAddr is unreachable")
+	}
+}
+
+func TestReconnectRequest(t *testing.T) {
+	a := &Agent{adslConfig: &AdslConfig{
+		MinRedialInterval: time.Hour,
+		lastRedial:        time.Now(),
+	}}
+
+	payload, _ := json.Marshal(ReconnectMsg{Reason: RedialReasonApi})
+	reqs := make(chan *ssh.Request, 1)
+	reqs <- &ssh.Request{Type: Reconnect, Payload: payload}
+	close(reqs)
+
+	conn := &fakeConn{}
+	done := make(chan bool)
+	go func() {
+		a.SshRequestHandler(conn, reqs)
+		close(done)
+	}()
+
+	// the request is taken while the handler may still be setting it
+	for i := 0; i < 100; i++ {
+		a.Reconnect()
+	}
+	<-done
+
+	if !conn.closed {
+		t.Error("session is not closed on reconnect request")
+	}
+
+	a.reconnectLock.Lock()
+	defer a.reconnectLock.Unlock()
+	if a.reconnectRequest != nil && a.reconnectRequest.Reason != RedialReasonApi {
+		t.Errorf("reconnect request %+v", a.reconnectRequest)
+	}
+}
+
+func TestRedialReport(t *testing.T) {
+	line := &fakeLine{ips: []string{"1.1.1.1", "2.2.2.2"}}
+	server := httptest.NewServer(line)
+	defer server.Close()
+
+	a := &Agent{
+		adslConfig:       newVerifiedConfig(line, server.URL),
+		reconnectRequest: &ReconnectMsg{Reason: RedialReasonApi, Force: true},
+	}
+
+	if !a.Reconnect() {
+		t.Fatal("line is not redialed on request")
+	}
+
+	report := a.redialReport
+	if report == nil || report.Reason != RedialReasonApi || report.PreviousIp != "1.1.1.1" || report.Ip != "2.2.2.2" || len(report.Attempts) != 1 {
+		t.Fatalf("report %+v", report)
+	}
+
+	// the report is kept with the time of disconnection until it is sent
+	disconnected := a.disconnected
+	if a.Reconnect() || a.redialReport != report || a.disconnected != disconnected {
+		t.Errorf("report %+v is not kept", a.redialReport)
+	}
+}
+
+// tunnelServer accepts the tunnels of the allowed forwards
+type tunnelServer struct {
+	allowed string
+}
+
+func (s *tunnelServer) CreateTunnel(left *net.TCPAddr, right, name, options string) (net.Listener, error) {
+	if name != s.allowed {
+		return nil, errors.Errorf("forward name %s is not allowed", name)
+	}
+
+	return net.Listen("tcp", "127.0.0.1:0")
+}
+
+func TestRejectedForwardIsSkipped(t *testing.T) {
+	http, _ := NewForward("http", "[::]:0", "localhost:3128", "")
+	socks, _ := NewForward("socks5", "[::]:0", "localhost:1080", "")
+
+	forwards, listeners := createTunnels(&tunnelServer{allowed: "http"}, []*Forward{socks, http})
+	for _, l := range listeners {
+		defer l.Close()
+	}
+
+	if len(forwards) != 1 || forwards[0] != http || len(listeners) != 1 {
+		t.Fatalf("tunnels of %v are created", forwards)
+	}
+
+	if http.Left.String() != listeners[0].Addr().String() {
+		t.Errorf("forward is bound to %s instead of %s", http.Left, listeners[0].Addr())
+	}
+}
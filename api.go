@@ -3,16 +3,20 @@ package adslproxy
 import (
 	"encoding/json"
 	"github.com/gorilla/mux"
+	"net"
 	"net/http"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type forwardPojo struct {
-	Name    string `json:"name"`
-	Left    string `json:"left"`
-	Right   string `json:"right"`
-	Options string `json:"options"`
+	Name        string `json:"name"`
+	Left        string `json:"left"`
+	Right       string `json:"right"`
+	Options     string `json:"options"`
+	ActiveConns int    `json:"active_conns"`
 }
 
 type nodePojo struct {
@@ -21,9 +25,18 @@ type nodePojo struct {
 	// Name of the agent
 	Name        string        `json:"name"`
 	RemoteIp    string        `json:"remote_ip"`
+	Labels      []string      `json:"labels"`
 	ForwardList []forwardPojo `json:"forward_list"`
 	// Heartbeat is the time of last heartbeat
 	Heartbeat time.Time `json:"heartbeat"`
+	// Draining is true when the node refuses new connections before a redial
+	Draining    bool `json:"draining"`
+	ActiveConns int  `json:"active_conns"`
+	// Blocked are the hosts whose canaries fail through the node
+	Blocked []string  `json:"blocked"`
+	Score   NodeScore `json:"score"`
+	// Breaker is the state of the circuit breaker, closed, open or half_open
+	Breaker string `json:"breaker"`
 }
 
 type route struct {
@@ -63,10 +76,11 @@ func (s *Server) ListNodesApi() func(w http.ResponseWriter, r *http.Request) {
 			var forwardList []forwardPojo
 			for _, forward := range node.ForwardList {
 				forwardList = append(forwardList, forwardPojo{
-					Name:    forward.Name,
-					Left:    forward.Left.String(),
-					Right:   forward.Right,
-					Options: forward.Options,
+					Name:        forward.Name,
+					Left:        forward.Left.String(),
+					Right:       forward.Right,
+					Options:     forward.Options,
+					ActiveConns: node.ForwardConns(forward),
 				})
 			}
 
@@ -74,8 +88,14 @@ func (s *Server) ListNodesApi() func(w http.ResponseWriter, r *http.Request) {
 				Id:          node.Id,
 				Name:        node.Name,
 				RemoteIp:    node.RemoteIp,
+				Labels:      node.Labels(),
 				Heartbeat:   node.Heartbeat,
 				ForwardList: forwardList,
+				Draining:    node.IsDraining(),
+				ActiveConns: node.ActiveConns(),
+				Blocked:     node.BlockedHosts(),
+				Score:       node.Score(s.ReportWindow),
+				Breaker:     node.breaker.State(),
 			})
 		}
 
@@ -95,8 +115,38 @@ func (s *Server) UpdateNodesApi() func(http.ResponseWriter, *http.Request) {
 
 			switch r.Method {
 			case "UPDATE":
-				node.Redial()
-				w.WriteHeader(200)
+				msg, err := parseReconnect(r)
+				if err != nil {
+					w.WriteHeader(400)
+					return
+				}
+
+				drain := r.URL.Query().Get("drain")
+				if drain == "" {
+					node.Redial(msg)
+					w.WriteHeader(200)
+					return
+				}
+
+				timeout, err := parseDrainTimeout(drain, s.DrainTimeout)
+				if err != nil {
+					w.WriteHeader(400)
+					return
+				}
+
+				if timeout == 0 {
+					node.Redial(msg)
+					w.WriteHeader(200)
+					return
+				}
+
+				if !node.markDraining() {
+					http.Error(w, "node is draining", 409)
+					return
+				}
+
+				go node.GracefulRedial(timeout, msg)
+				w.WriteHeader(202)
 			default:
 				w.WriteHeader(400)
 			}
@@ -106,10 +156,430 @@ func (s *Server) UpdateNodesApi() func(http.ResponseWriter, *http.Request) {
 	}
 }
 
+// parseReconnect reads the reason, delay (e.g. 10s) and force of a redial from the query
+func parseReconnect(r *http.Request) (ReconnectMsg, error) {
+	query := r.URL.Query()
+	msg := ReconnectMsg{Reason: query.Get("reason")}
+	if msg.Reason == "" {
+		msg.Reason = RedialReasonApi
+	}
+
+	if delay := query.Get("delay"); delay != "" {
+		d, err := time.ParseDuration(delay)
+		if err != nil {
+			return msg, err
+		}
+		msg.Delay = int64(d / time.Millisecond)
+	}
+
+	if force := query.Get("force"); force != "" {
+		var err error
+		if msg.Force, err = strconv.ParseBool(force); err != nil {
+			return msg, err
+		}
+	}
+
+	return msg, nil
+}
+
+// parseDrainTimeout accepts either a duration (e.g. 10s) or a boolean meaning
+// the default timeout should be used, 0 means no drain
+func parseDrainTimeout(value string, defaultTimeout time.Duration) (time.Duration, error) {
+	if enabled, err := strconv.ParseBool(value); err == nil {
+		if !enabled {
+			return 0, nil
+		}
+
+		return defaultTimeout, nil
+	}
+
+	return time.ParseDuration(value)
+}
+
+type portPinPojo struct {
+	Port int `json:"port"`
+}
+
+func (s *Server) ListPortsApi() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.PortAllocator == nil {
+			w.WriteHeader(404)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(s.PortAllocator.List())
+	}
+}
+
+func (s *Server) UpdatePortsApi() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.PortAllocator == nil {
+			w.WriteHeader(404)
+			return
+		}
+
+		vars := mux.Vars(r)
+		node := vars["node"]
+		forward := vars["forward"]
+
+		switch r.Method {
+		case "PUT":
+			var pin portPinPojo
+			if err := json.NewDecoder(r.Body).Decode(&pin); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+
+			if err := s.PortAllocator.Pin(node, forward, pin.Port); err != nil {
+				http.Error(w, err.Error(), 409)
+				return
+			}
+
+			w.WriteHeader(200)
+		case "DELETE":
+			if err := s.PortAllocator.Remove(node, forward); err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+
+			w.WriteHeader(200)
+		default:
+			w.WriteHeader(400)
+		}
+	}
+}
+
+type accessListPojo struct {
+	Rules  accessListFile    `json:"rules"`
+	Denied map[string]uint64 `json:"denied"`
+}
+
+// AccessListApi shows the allowlists with GET, and reloads them with POST
+func (s *Server) AccessListApi() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.AccessList == nil {
+			w.WriteHeader(404)
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+		case "POST":
+			if err := s.AccessList.Reload(); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+		default:
+			w.WriteHeader(400)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(accessListPojo{
+			Rules:  s.AccessList.rules(),
+			Denied: s.AccessList.Denied(),
+		})
+	}
+}
+
+type consumerPojo struct {
+	Name        string `json:"name"`
+	HasPassword bool   `json:"has_password"`
+	ApiKeys     int    `json:"api_keys"`
+	Disabled    bool   `json:"disabled"`
+}
+
+func (s *Server) ListConsumersApi() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.Consumers == nil {
+			w.WriteHeader(404)
+			return
+		}
+
+		var data = make([]consumerPojo, 0)
+		for _, c := range s.Consumers.List() {
+			data = append(data, consumerPojo{
+				Name:        c.Name,
+				HasPassword: c.Password != "",
+				ApiKeys:     len(c.ApiKeys),
+				Disabled:    c.Disabled,
+			})
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(data)
+	}
+}
+
+// UpdateConsumersApi creates or replaces a consumer with PUT, and removes it with DELETE
+func (s *Server) UpdateConsumersApi() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.Consumers == nil {
+			w.WriteHeader(404)
+			return
+		}
+
+		name := mux.Vars(r)["name"]
+
+		switch r.Method {
+		case "PUT":
+			var c Consumer
+			if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+
+			c.Name = name
+			if err := s.Consumers.Put(&c); err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+
+			w.WriteHeader(200)
+		case "DELETE":
+			if err := s.Consumers.Remove(name); err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+
+			w.WriteHeader(200)
+		default:
+			w.WriteHeader(400)
+		}
+	}
+}
+
+// UsageApi exports the usages of consumers as json, or csv with format=csv
+func (s *Server) UsageApi() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.Usage == nil {
+			w.WriteHeader(404)
+			return
+		}
+
+		usages := s.Usage.List(r.URL.Query().Get("consumer"))
+
+		if r.URL.Query().Get("format") == "csv" {
+			w.Header().Add("Content-Type", "text/csv")
+			w.WriteHeader(200)
+			WriteUsageCsv(w, usages)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(usages)
+	}
+}
+
+func (s *Server) ListThrottleApi() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(s.Throttle.Limits())
+	}
+}
+
+// UpdateThrottleApi sets the limit of a scope with PUT, and removes it with
+// DELETE. The change is applied to live connections and pushed to agents.
+func (s *Server) UpdateThrottleApi() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scope := mux.Vars(r)["scope"]
+
+		switch r.Method {
+		case "PUT":
+			var limit RateLimit
+			if err := json.NewDecoder(r.Body).Decode(&limit); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+
+			s.Throttle.Set(scope, limit)
+		case "DELETE":
+			s.Throttle.Remove(scope)
+		default:
+			w.WriteHeader(400)
+			return
+		}
+
+		for _, node := range s.ListNodes() {
+			s.pushLimits(node)
+		}
+
+		w.WriteHeader(200)
+	}
+}
+
+type reportPojo struct {
+	Reason string `json:"reason"`
+}
+
+type reportResultPojo struct {
+	NodeId  string `json:"node_id"`
+	Ip      string `json:"ip"`
+	Reports int    `json:"reports"`
+}
+
+// ReportApi takes a bad ip report of a node, by its id or its exit ip
+func (s *Server) ReportApi() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(400)
+			return
+		}
+
+		var report reportPojo
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+		}
+
+		if report.Reason == "" {
+			report.Reason = RedialReasonReported
+		}
+
+		vars := mux.Vars(r)
+		var node *Node
+		if ip, ok := vars["ip"]; ok {
+			node = s.FindNodeByIp(ip)
+			if node == nil {
+				// the node may have been redialed already
+				s.History.Report(ip, report.Reason)
+			}
+		} else {
+			node = s.FindNodeById(vars["node_id"])
+		}
+
+		if node == nil {
+			w.WriteHeader(404)
+			return
+		}
+
+		count := s.ReportNode(node, report.Reason)
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(reportResultPojo{
+			NodeId:  node.Id,
+			Ip:      node.RemoteIp,
+			Reports: count,
+		})
+	}
+}
+
+// CanariesApi returns the last canary results of the node, POST runs the canaries now
+func (s *Server) CanariesApi() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		node := s.FindNodeById(mux.Vars(r)["node_id"])
+		if node == nil {
+			w.WriteHeader(404)
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+		case "POST":
+			s.checkCanaries(node)
+		default:
+			w.WriteHeader(400)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(node.CanaryResults())
+	}
+}
+
+// ListEventsApi returns the events, or the ones after the time given by since in RFC 3339
+func (s *Server) ListEventsApi() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var since time.Time
+		if value := r.URL.Query().Get("since"); value != "" {
+			var err error
+			if since, err = time.Parse(time.RFC3339, value); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(s.Events.List(since))
+	}
+}
+
+// ListRedialsApi returns the redial reports of a node, which may be redialing now
+func (s *Server) ListRedialsApi() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		nodeId := mux.Vars(r)["node_id"]
+		redials := s.History.Redials(nodeId)
+		if redials == nil {
+			if s.FindNodeById(nodeId) == nil {
+				w.WriteHeader(404)
+				return
+			}
+
+			redials = make([]RedialRecord, 0)
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(redials)
+	}
+}
+
+func (s *Server) ListIpsApi() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(s.History.List())
+	}
+}
+
+// adminOnly requires the AdminToken as a bearer token, or a client on the
+// loopback if AdminToken is empty
+func (s *Server) adminOnly(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.AdminToken != "" {
+			auth := r.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "Bearer ") || !secretEqual(strings.TrimPrefix(auth, "Bearer "), s.AdminToken) {
+				w.WriteHeader(401)
+				return
+			}
+		} else if host, _, err := net.SplitHostPort(r.RemoteAddr); err != nil || !net.ParseIP(host).IsLoopback() {
+			w.WriteHeader(403)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
 func (s *Server) apiHandler() http.Handler {
 	r := mux.NewRouter()
 
 	r.HandleFunc("/api/nodes/", s.ListNodesApi())
 	r.HandleFunc("/api/nodes/{node_id}/", s.UpdateNodesApi())
+	r.HandleFunc("/api/nodes/{node_id}/report/", s.ReportApi())
+	r.HandleFunc("/api/nodes/{node_id}/canaries/", s.CanariesApi())
+	r.HandleFunc("/api/nodes/{node_id}/redials/", s.ListRedialsApi())
+	r.HandleFunc("/api/ips/", s.ListIpsApi())
+	r.HandleFunc("/api/events/", s.ListEventsApi())
+	r.HandleFunc("/api/ips/{ip}/report/", s.ReportApi())
+	r.HandleFunc("/api/ports/", s.ListPortsApi())
+	r.HandleFunc("/api/ports/{node}/{forward}/", s.adminOnly(s.UpdatePortsApi()))
+	r.HandleFunc("/api/acl/", s.adminOnly(s.AccessListApi()))
+	r.HandleFunc("/api/consumers/", s.adminOnly(s.ListConsumersApi()))
+	r.HandleFunc("/api/consumers/{name}/", s.adminOnly(s.UpdateConsumersApi()))
+	r.HandleFunc("/api/usage/", s.adminOnly(s.UsageApi()))
+	r.HandleFunc("/api/throttle/", s.ListThrottleApi())
+	r.HandleFunc("/api/throttle/{scope}/", s.adminOnly(s.UpdateThrottleApi()))
 	return r
 }
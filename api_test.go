@@ -0,0 +1,224 @@
+package adslproxy
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func updateNode(s *Server, nodeId, query string) int {
+	r := httptest.NewRequest("UPDATE", "/api/nodes/"+nodeId+"/"+query, nil)
+	r = mux.SetURLVars(r, map[string]string{"node_id": nodeId})
+	w := httptest.NewRecorder()
+	s.UpdateNodesApi()(w, r)
+	return w.Code
+}
+
+func TestUpdateNodeWithoutDrain(t *testing.T) {
+	node, conn := newTestNode("a")
+	s := newTestServer(node)
+
+	for _, query := range []string{"", "?drain=false", "?drain=0s"} {
+		conn.requests = nil
+		if code := updateNode(s, "a", query); code != http.StatusOK {
+			t.Errorf("redial%s returns %d", query, code)
+		}
+
+		if len(conn.sent(Reconnect)) != 1 {
+			t.Errorf("node is not redialed at once by redial%s", query)
+		}
+
+		if node.IsDraining() {
+			t.Errorf("node is draining after redial%s", query)
+		}
+	}
+
+	if code := updateNode(s, "b", ""); code != http.StatusNotFound {
+		t.Errorf("redial of unknown node returns %d", code)
+	}
+}
+
+func TestUpdateNodeDrainInProgress(t *testing.T) {
+	node, _ := newTestNode("a")
+	s := newTestServer(node)
+	node.tryAcquire(&Forward{Name: "http"}, 0, 0)
+
+	if code := updateNode(s, "a", "?drain=10s"); code != http.StatusAccepted {
+		t.Fatalf("drain returns %d", code)
+	}
+
+	if code := updateNode(s, "a", "?drain=true"); code != http.StatusConflict {
+		t.Errorf("second drain returns %d", code)
+	}
+
+	if code := updateNode(s, "a", "?drain=abc"); code != http.StatusBadRequest {
+		t.Errorf("illegal drain returns %d", code)
+	}
+}
+
+func TestParseDrainTimeout(t *testing.T) {
+	cases := map[string]int64{
+		"true":  int64(DefaultDrainTimeout),
+		"1":     int64(DefaultDrainTimeout),
+		"false": 0,
+		"10s":   10e9,
+	}
+
+	for value, expected := range cases {
+		timeout, err := parseDrainTimeout(value, DefaultDrainTimeout)
+		if err != nil || int64(timeout) != expected {
+			t.Errorf("drain %s is parsed to %s %v", value, timeout, err)
+		}
+	}
+
+	if _, err := parseDrainTimeout("abc", DefaultDrainTimeout); err == nil {
+		t.Error("illegal drain is accepted")
+	}
+}
+
+func TestConsumersApiRequiresAdmin(t *testing.T) {
+	consumers, _ := NewConsumerStore("")
+	s := newTestServer()
+	s.Consumers = consumers
+	handler := s.adminOnly(s.ListConsumersApi())
+
+	request := func(remoteAddr, authorization string) int {
+		r := httptest.NewRequest("GET", "/api/consumers/", nil)
+		r.RemoteAddr = remoteAddr
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	if code := request("192.0.2.1:40000", ""); code != http.StatusForbidden {
+		t.Errorf("remote client without token gets %d", code)
+	}
+
+	if code := request("127.0.0.1:40000", ""); code != http.StatusOK {
+		t.Errorf("local client gets %d", code)
+	}
+
+	s.AdminToken = "admin"
+	if code := request("127.0.0.1:40000", ""); code != http.StatusUnauthorized {
+		t.Errorf("client without token gets %d", code)
+	}
+
+	if code := request("192.0.2.1:40000", "Bearer wrong"); code != http.StatusUnauthorized {
+		t.Errorf("client with wrong token gets %d", code)
+	}
+
+	if code := request("192.0.2.1:40000", "Bearer admin"); code != http.StatusOK {
+		t.Errorf("client with token gets %d", code)
+	}
+}
+
+func reportNode(s *Server, vars map[string]string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/api/report/", strings.NewReader(body))
+	r = mux.SetURLVars(r, vars)
+	w := httptest.NewRecorder()
+	s.ReportApi()(w, r)
+	return w
+}
+
+func TestReportApi(t *testing.T) {
+	node, conn := newTestNode("a")
+	node.RemoteIp = "198.51.100.7"
+	s := newTestServer(node)
+	s.History.Seen(node)
+	s.ReportThreshold = 2
+	s.ReportWindow = time.Minute
+
+	w := reportNode(s, map[string]string{"node_id": "a"}, `{"reason": "captcha"}`)
+	var result reportResultPojo
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil || result.Reports != 1 || result.Ip != "198.51.100.7" {
+		t.Errorf("report returns %d %+v %v", w.Code, result, err)
+	}
+
+	if node.IsDraining() {
+		t.Error("node is retired under the threshold")
+	}
+
+	// the node is found by its exit ip, and redialed at the threshold
+	if w := reportNode(s, map[string]string{"ip": "198.51.100.7"}, ""); w.Code != http.StatusOK {
+		t.Fatalf("report by ip returns %d", w.Code)
+	}
+
+	if !node.IsDraining() {
+		t.Error("node is not retired at the threshold")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(conn.sent(Reconnect)) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(conn.sent(Reconnect)) != 1 {
+		t.Error("retired node is not redialed")
+	}
+
+	records := s.History.List()
+	// a report without reason still retires the ip
+	if len(records) != 1 || len(records[0].Reports) != 2 || records[0].RetiredReason != RedialReasonReported {
+		t.Errorf("history %+v", records)
+	}
+
+	if w := reportNode(s, map[string]string{"node_id": "b"}, ""); w.Code != http.StatusNotFound {
+		t.Errorf("report of unknown node returns %d", w.Code)
+	}
+}
+
+func TestReportApiOfGoneNode(t *testing.T) {
+	node, _ := newTestNode("a")
+	node.RemoteIp = "198.51.100.7"
+	s := newTestServer()
+	s.History.Seen(node)
+
+	// the node has been redialed, the report is kept in the history of its ip
+	if w := reportNode(s, map[string]string{"ip": "198.51.100.7"}, ""); w.Code != http.StatusNotFound {
+		t.Errorf("report of gone node returns %d", w.Code)
+	}
+
+	records := s.History.List()
+	if len(records) != 1 || len(records[0].Reports) != 1 || records[0].Reports[0].Reason != RedialReasonReported {
+		t.Errorf("history %+v", records)
+	}
+}
+
+func TestListRedialsApi(t *testing.T) {
+	node, _ := newTestNode("a")
+	s := newTestServer(node)
+
+	list := func(nodeId string) (int, []RedialRecord) {
+		r := httptest.NewRequest("GET", "/api/nodes/"+nodeId+"/redials/", nil)
+		r = mux.SetURLVars(r, map[string]string{"node_id": nodeId})
+		w := httptest.NewRecorder()
+		s.ListRedialsApi()(w, r)
+
+		var redials []RedialRecord
+		json.NewDecoder(w.Body).Decode(&redials)
+		return w.Code, redials
+	}
+
+	if code, redials := list("a"); code != http.StatusOK || redials == nil || len(redials) != 0 {
+		t.Errorf("redials of a node never redialed %d %+v", code, redials)
+	}
+
+	if code, _ := list("b"); code != http.StatusNotFound {
+		t.Errorf("redials of unknown node returns %d", code)
+	}
+
+	// the reports are kept while the node is redialing
+	s.History.AddRedial(node, RedialReportMsg{Reason: RedialReasonRequested, Ip: "198.51.100.2"})
+	s.Nodes.Init()
+	if code, redials := list("a"); code != http.StatusOK || len(redials) != 1 || redials[0].Ip != "198.51.100.2" {
+		t.Errorf("redials %d %+v", code, redials)
+	}
+}
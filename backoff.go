@@ -0,0 +1,49 @@
+package adslproxy
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff is a capped exponential backoff with jitter
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+	// Jitter is the fraction of a delay which is randomized, from 0 to 1
+	Jitter float64
+
+	attempts int
+}
+
+func NewBackoff(min, max time.Duration) *Backoff {
+	return &Backoff{
+		Min:    min,
+		Max:    max,
+		Jitter: DefaultBackoffJitter,
+	}
+}
+
+// Next returns the delay after another failure
+func (b *Backoff) Next() time.Duration {
+	delay := b.Min
+	for i := 0; i < b.attempts && delay < b.Max; i++ {
+		delay *= 2
+	}
+
+	if delay > b.Max {
+		delay = b.Max
+	}
+
+	b.attempts++
+	return delay - time.Duration(b.Jitter*rand.Float64()*float64(delay))
+}
+
+// Reset is called after a success
+func (b *Backoff) Reset() {
+	b.attempts = 0
+}
+
+// Attempts returns the number of failures since the last success
+func (b *Backoff) Attempts() int {
+	return b.attempts
+}
@@ -0,0 +1,59 @@
+package adslproxy
+
+import (
+	"github.com/pkg/errors"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := NewBackoff(time.Second, 8*time.Second)
+	b.Jitter = 0
+
+	for _, expected := range []time.Duration{1, 2, 4, 8, 8} {
+		if delay := b.Next(); delay != expected*time.Second {
+			t.Errorf("delay %s, expected %ds", delay, expected)
+		}
+	}
+
+	if b.Attempts() != 5 {
+		t.Errorf("%d attempts", b.Attempts())
+	}
+
+	b.Reset()
+	if delay := b.Next(); delay != time.Second {
+		t.Errorf("delay after reset %s", delay)
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b := NewBackoff(time.Second, time.Minute)
+	b.Jitter = 0.5
+
+	for i := 0; i < 100; i++ {
+		b.Reset()
+		if delay := b.Next(); delay <= 500*time.Millisecond || delay > time.Second {
+			t.Fatalf("delay %s out of jitter", delay)
+		}
+	}
+}
+
+func TestConnectDelay(t *testing.T) {
+	a := &Agent{ConnectBackoff: NewBackoff(time.Second, time.Minute)}
+	a.ConnectBackoff.Jitter = 0
+
+	// failures are backed off whether the line is redialed or not
+	a.connectDelay(errors.New("connection refused"))
+	if delay := a.connectDelay(errors.New("connection refused")); delay != 2*time.Second {
+		t.Errorf("delay %s", delay)
+	}
+
+	status := a.Status()
+	if status.ConnectFailures != 2 || status.LastError != "connection refused" {
+		t.Errorf("status %+v", status)
+	}
+
+	if delay := a.connectDelay(nil); delay != 0 || a.ConnectBackoff.Attempts() != 0 {
+		t.Errorf("delay after a session %s", delay)
+	}
+}
@@ -0,0 +1,162 @@
+package adslproxy
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// circuitBreaker ejects a node from selection after consecutive dial
+// failures. When the backoff is over, one trial connection at a time is let
+// through, the node is back if it succeeds, or ejected again with a doubled
+// backoff if it fails.
+type circuitBreaker struct {
+	lock     sync.Mutex
+	state    string
+	failures int
+	backoff  time.Duration
+	until    time.Time
+	trialing bool
+}
+
+// allow reports whether a connection may go through the node, and whether
+// it is the trial connection of a half open breaker. Only the connection
+// which takes the trial calls endTrial.
+func (b *circuitBreaker) allow() (allowed, trial, halfOpened bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Now().Before(b.until) {
+			return false, false, false
+		}
+
+		b.state = BreakerHalfOpen
+		b.trialing = true
+		return true, true, true
+	case BreakerHalfOpen:
+		if b.trialing {
+			return false, false, false
+		}
+
+		b.trialing = true
+		return true, true, false
+	}
+
+	return true, false, false
+}
+
+// endTrial lets the next trial connection through if the current one ended
+// without a result
+func (b *circuitBreaker) endTrial() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.trialing = false
+}
+
+// success returns true if the node is recovered by a trial connection
+func (b *circuitBreaker) success() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.failures = 0
+	if b.state != BreakerHalfOpen {
+		return false
+	}
+
+	b.state = BreakerClosed
+	b.backoff = 0
+	b.trialing = false
+	return true
+}
+
+// failure returns true if the node is ejected by the failure
+func (b *circuitBreaker) failure(threshold int, backoff, maxBackoff time.Duration) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.failures++
+	switch b.state {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		b.backoff *= 2
+		if maxBackoff > 0 && b.backoff > maxBackoff {
+			b.backoff = maxBackoff
+		}
+	default:
+		if threshold <= 0 || b.failures < threshold {
+			return false
+		}
+
+		b.backoff = backoff
+	}
+
+	b.state = BreakerOpen
+	b.until = time.Now().Add(b.backoff)
+	b.trialing = false
+	return true
+}
+
+func (b *circuitBreaker) State() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.state == "" {
+		return BreakerClosed
+	}
+
+	return b.state
+}
+
+// admit checks the breaker of the node and acquires a connection slot on it,
+// trial is true if the connection is the trial one of a half open breaker
+func (s *Server) admit(node *Node, f *Forward) (admitted, trial bool) {
+	allowed, trial, halfOpened := node.breaker.allow()
+	if !allowed {
+		return false, false
+	}
+
+	if halfOpened {
+		s.Events.Emit(EventNodeHalfOpen, node, "backoff is over")
+	}
+
+	if !node.tryAcquire(f, s.MaxNodeConns, s.MaxForwardConns) {
+		if trial {
+			node.breaker.endTrial()
+		}
+		return false, false
+	}
+
+	return true, trial
+}
+
+// releaseSlot releases the connection slot acquired by admit
+func releaseSlot(node *Node, f *Forward, trial bool) {
+	node.release(f)
+	if trial {
+		node.breaker.endTrial()
+	}
+}
+
+// dialFailed records a failed connection through the node
+func (s *Server) dialFailed(node *Node, reason string) {
+	node.addDialError(s.ReportWindow)
+	if node.breaker.failure(s.BreakerFailures, s.BreakerBackoff, s.BreakerMaxBackoff) {
+		s.Events.Emit(EventNodeEjected, node, reason)
+	}
+}
+
+// dialSucceeded records a connection through the node which got data from the agent
+func (s *Server) dialSucceeded(node *Node) {
+	if node.breaker.success() {
+		s.Events.Emit(EventNodeRecovered, node, "trial connection succeeded")
+	}
+}
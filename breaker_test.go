@@ -0,0 +1,80 @@
+package adslproxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := &circuitBreaker{}
+	if b.failure(2, time.Hour, 0) || b.State() != BreakerClosed {
+		t.Error("breaker is opened under the threshold")
+	}
+
+	if !b.failure(2, 10*time.Millisecond, time.Hour) || b.State() != BreakerOpen {
+		t.Fatal("breaker is not opened at the threshold")
+	}
+
+	if allowed, _, _ := b.allow(); allowed {
+		t.Error("connection is allowed through an open breaker")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	allowed, trial, halfOpened := b.allow()
+	if !allowed || !trial || !halfOpened {
+		t.Fatalf("trial connection allowed %v trial %v half opened %v", allowed, trial, halfOpened)
+	}
+
+	if allowed, _, _ := b.allow(); allowed {
+		t.Error("a second trial connection is allowed")
+	}
+
+	// a failed trial doubles the backoff
+	if !b.failure(2, 10*time.Millisecond, time.Hour) || b.backoff != 20*time.Millisecond {
+		t.Errorf("backoff after failed trial %s", b.backoff)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	b.allow()
+	if !b.success() || b.State() != BreakerClosed {
+		t.Error("breaker is not closed by a successful trial")
+	}
+
+	if allowed, trial, _ := b.allow(); !allowed || trial {
+		t.Error("connection through a closed breaker is a trial")
+	}
+}
+
+func TestOnlyTrialConnectionEndsTrial(t *testing.T) {
+	s := newTestServer()
+	s.BreakerFailures = 1
+	s.BreakerBackoff = time.Millisecond
+
+	node, _ := newTestNode("a")
+	f := &Forward{Name: "http"}
+
+	// a connection admitted before the node is ejected
+	admitted, trial := s.admit(node, f)
+	if !admitted || trial {
+		t.Fatalf("admitted %v trial %v", admitted, trial)
+	}
+
+	s.dialFailed(node, "test")
+	time.Sleep(5 * time.Millisecond)
+
+	admitted, trial = s.admit(node, f)
+	if !admitted || !trial {
+		t.Fatalf("trial connection admitted %v trial %v", admitted, trial)
+	}
+
+	// the earlier connection ends while the trial is going on
+	releaseSlot(node, f, false)
+	if admitted, _ := s.admit(node, f); admitted {
+		t.Error("the trial is ended by another connection")
+	}
+
+	releaseSlot(node, f, true)
+	if admitted, trial := s.admit(node, f); !admitted || !trial {
+		t.Error("next trial is not allowed after the trial connection ends")
+	}
+}
@@ -0,0 +1,315 @@
+package adslproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gocloudio/crypto/ssh"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// canaryBodyLimit is the max bytes of a response body matched by a canary
+const canaryBodyLimit = 1 << 20
+
+// Canary is a url which is fetched through every node to find out whether
+// its exit ip is blocked by the site
+type Canary struct {
+	Name string `json:"name"`
+	Url  string `json:"url"`
+	// Forward is the name of the http proxy forward which the check goes through, "http" if empty
+	Forward string `json:"forward"`
+	// Status is the expected status code, 200 if 0
+	Status int `json:"status"`
+	// BodyMatch is a regexp which the body is expected to match, the body is not checked if empty
+	BodyMatch string `json:"body_match"`
+	// Redial makes the node redial when the canary fails through it
+	Redial bool `json:"redial"`
+
+	host      string
+	bodyMatch *regexp.Regexp
+}
+
+// CanaryResult is the last check of a canary through a node
+type CanaryResult struct {
+	Canary string    `json:"canary"`
+	Ok     bool      `json:"ok"`
+	Status int       `json:"status,omitempty"`
+	Error  string    `json:"error,omitempty"`
+	Time   time.Time `json:"time"`
+	// Misconfigured is set if the proxy of the forward refuses the credential
+	// of the canary, which tells nothing about the exit ip
+	Misconfigured bool `json:"misconfigured,omitempty"`
+}
+
+// LoadCanaries reads a json array of canaries
+func LoadCanaries(path string) ([]*Canary, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var canaries []*Canary
+	if err := json.Unmarshal(data, &canaries); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse canaries %s", path)
+	}
+
+	for _, c := range canaries {
+		u, err := url.Parse(c.Url)
+		if err != nil {
+			return nil, errors.Wrapf(err, "illegal url of canary %s", c.Name)
+		}
+		c.host = strings.ToLower(u.Hostname())
+
+		if c.BodyMatch != "" {
+			if c.bodyMatch, err = regexp.Compile(c.BodyMatch); err != nil {
+				return nil, errors.Wrapf(err, "illegal body match of canary %s", c.Name)
+			}
+		}
+
+		if c.Name == "" {
+			c.Name = c.host
+		}
+
+		if c.Forward == "" {
+			c.Forward = "http"
+		}
+
+		if c.Status == 0 {
+			c.Status = http.StatusOK
+		}
+	}
+
+	return canaries, nil
+}
+
+// channelConn adapts a forwarded-tcpip channel to net.Conn for http.Transport,
+// deadlines are left to the timeout of http.Client
+type channelConn struct {
+	ssh.Channel
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *channelConn) LocalAddr() net.Addr                { return c.local }
+func (c *channelConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *channelConn) SetDeadline(t time.Time) error      { return nil }
+func (c *channelConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *channelConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// check fetches the url of the canary through the forward of the node
+func (c *Canary) check(node *Node, f *Forward) CanaryResult {
+	result := CanaryResult{Canary: c.Name, Time: time.Now()}
+	origin := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	// the options of a forward of the built-in proxies are its credential
+	proxy := &url.URL{Scheme: "http", Host: f.Left.String()}
+	if f.Options != "" {
+		credential := strings.SplitN(f.Options, ":", 2)
+		if len(credential) == 2 {
+			proxy.User = url.UserPassword(credential[0], credential[1])
+		} else {
+			proxy.User = url.User(credential[0])
+		}
+	}
+
+	client := &http.Client{
+		Timeout: CanaryTimeout,
+		Transport: &http.Transport{
+			// the proxy address is never dialed, the channel to the forward is opened instead
+			Proxy: http.ProxyURL(proxy),
+			Dial: func(network, addr string) (net.Conn, error) {
+				channel, err := node.openForwardChannel(f, origin)
+				if err != nil {
+					return nil, err
+				}
+
+				return &channelConn{Channel: channel, local: origin, remote: f.Left}, nil
+			},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get(c.Url)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+
+	result.Status = resp.StatusCode
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		result.Error = "proxy authentication of " + f.Name + " failed"
+		result.Misconfigured = true
+		return result
+	}
+
+	if resp.StatusCode != c.Status {
+		result.Error = fmt.Sprintf("status %d is not %d", resp.StatusCode, c.Status)
+		return result
+	}
+
+	if c.bodyMatch != nil {
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, canaryBodyLimit))
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+
+		if !c.bodyMatch.Match(body) {
+			result.Error = "body does not match " + c.BodyMatch
+			return result
+		}
+	}
+
+	result.Ok = true
+	return result
+}
+
+// setCanaryResult records the result and blocks or unblocks the host of the
+// canary, true is returned if the node is newly blocked for the host. A
+// misconfigured canary leaves the host as it is.
+func (n *Node) setCanaryResult(c *Canary, r CanaryResult) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.canaries == nil {
+		n.canaries = make(map[string]CanaryResult)
+		n.blocked = make(map[string]string)
+	}
+
+	n.canaries[c.Name] = r
+	if r.Misconfigured {
+		return false
+	}
+
+	if r.Ok {
+		if n.blocked[c.host] == c.Name {
+			delete(n.blocked, c.host)
+		}
+		return false
+	}
+
+	_, ok := n.blocked[c.host]
+	n.blocked[c.host] = c.Name
+	return !ok
+}
+
+func (n *Node) CanaryResults() []CanaryResult {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	results := make([]CanaryResult, 0, len(n.canaries))
+	for _, r := range n.canaries {
+		results = append(results, r)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Canary < results[j].Canary
+	})
+
+	return results
+}
+
+// BlockedHosts returns the hosts whose canaries fail through the node
+func (n *Node) BlockedHosts() []string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	hosts := make([]string, 0, len(n.blocked))
+	for host := range n.blocked {
+		hosts = append(hosts, host)
+	}
+
+	sort.Strings(hosts)
+	return hosts
+}
+
+// IsBlocked reports whether the node is blocked for the target, which is a
+// host with an optional port. A subdomain of a blocked host is blocked too.
+func (n *Node) IsBlocked(target string) bool {
+	if target == "" {
+		return false
+	}
+
+	host := target
+	if h, _, err := net.SplitHostPort(target); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for blocked := range n.blocked {
+		if host == blocked || strings.HasSuffix(host, "."+blocked) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkCanaries runs every canary through the node
+func (s *Server) checkCanaries(node *Node) {
+	for _, c := range s.Canaries {
+		var f *Forward
+		for _, forward := range node.ForwardList {
+			if forward.Name == c.Forward {
+				f = forward
+			}
+		}
+
+		if f == nil {
+			continue
+		}
+
+		result := c.check(node, f)
+		if !node.setCanaryResult(c, result) {
+			continue
+		}
+
+		reason := fmt.Sprintf("canary %s failed %s", c.Name, result.Error)
+		glog.Infof("%s is blocked for %s, %s", node, c.host, reason)
+		s.History.Report(node.RemoteIp, reason)
+
+		if c.Redial {
+			s.retireNode(node, reason)
+			return
+		}
+	}
+}
+
+// runCanaries checks the canaries through all nodes every CanaryInterval
+func (s *Server) runCanaries() {
+	interval := s.CanaryInterval
+	if interval <= 0 {
+		interval = DefaultCanaryInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if s.stopped {
+			return
+		}
+
+		for _, node := range s.ListNodes() {
+			if !node.IsDraining() {
+				go s.checkCanaries(node)
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package adslproxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// serveProxy answers the http proxy requests through the channel with the
+// response of the host
+func serveProxy(responses map[string]string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		defer conn.Close()
+
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+
+		response, ok := responses[req.URL.Host]
+		if !ok {
+			response = "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n"
+		}
+
+		fmt.Fprint(conn, response)
+	}
+}
+
+func newCanaryNode(id string, responses map[string]string) (*Node, *Forward) {
+	return newForwardNode(id, "http", serveProxy(responses))
+}
+
+func loadCanaries(t *testing.T, content string) []*Canary {
+	canaries, err := LoadCanaries(writeTempFile(t, "canaries.json", content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return canaries
+}
+
+func TestLoadCanaries(t *testing.T) {
+	c := loadCanaries(t, `[{"url": "https://Example.com/ping"}]`)[0]
+	if c.Name != "example.com" || c.Forward != "http" || c.Status != http.StatusOK || c.host != "example.com" {
+		t.Errorf("canary %+v", c)
+	}
+
+	if _, err := LoadCanaries(writeTempFile(t, "canaries.json", `[{"url": "http://a", "body_match": "("}]`)); err == nil {
+		t.Error("illegal body match is loaded")
+	}
+}
+
+func TestCanaryCheck(t *testing.T) {
+	canaries := loadCanaries(t, `[
+		{"name": "ok", "url": "http://ok.example/"},
+		{"name": "body", "url": "http://body.example/", "body_match": "welcome"},
+		{"name": "status", "url": "http://status.example/"},
+		{"name": "down", "url": "http://down.example/"}
+	]`)
+
+	node, f := newCanaryNode("a", map[string]string{
+		"ok.example":     "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok",
+		"body.example":   "HTTP/1.1 200 OK\r\nContent-Length: 7\r\n\r\ncaptcha",
+		"status.example": "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n",
+	})
+
+	expected := map[string]bool{"ok": true, "body": false, "status": false, "down": false}
+	for _, c := range canaries {
+		if r := c.check(node, f); r.Ok != expected[c.Name] {
+			t.Errorf("canary %s %+v", c.Name, r)
+		}
+	}
+}
+
+func TestCanaryOfAuthForward(t *testing.T) {
+	c := loadCanaries(t, `[{"url": "http://example.com/"}]`)[0]
+
+	// the built-in proxy of agent requires the credential in the options of the forward
+	node, f := newForwardNode("a", "http", func(conn net.Conn) {
+		defer conn.Close()
+
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+
+		if req.Header.Get("Proxy-Authorization") != basicAuth("user", "pass") {
+			fmt.Fprint(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+
+		fmt.Fprint(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+
+	f.Options = "user:pass"
+	if r := c.check(node, f); !r.Ok {
+		t.Errorf("canary with the credential of the forward %+v", r)
+	}
+
+	f.Options = "user:wrong"
+	r := c.check(node, f)
+	if r.Ok || !r.Misconfigured {
+		t.Errorf("canary with a wrong credential %+v", r)
+	}
+
+	if node.setCanaryResult(c, r) || node.IsBlocked("example.com") {
+		t.Error("node is blocked by a misconfigured canary")
+	}
+}
+
+func TestCanaryBlocksHost(t *testing.T) {
+	c := loadCanaries(t, `[{"url": "http://example.com/"}]`)[0]
+	node, _ := newTestNode("a")
+
+	if !node.setCanaryResult(c, CanaryResult{Canary: c.Name}) {
+		t.Error("node is not blocked by a failed canary")
+	}
+
+	if node.setCanaryResult(c, CanaryResult{Canary: c.Name}) {
+		t.Error("node is blocked again")
+	}
+
+	for target, blocked := range map[string]bool{
+		"example.com:443":    true,
+		"WWW.example.com":    true,
+		"notexample.com:443": false,
+		"example.org":        false,
+		"":                   false,
+	} {
+		if node.IsBlocked(target) != blocked {
+			t.Errorf("%s blocked %v", target, !blocked)
+		}
+	}
+
+	node.setCanaryResult(c, CanaryResult{Canary: c.Name, Ok: true})
+	if node.IsBlocked("example.com") || len(node.BlockedHosts()) != 0 {
+		t.Error("node is still blocked after the canary passes")
+	}
+}
+
+func TestCheckCanariesRedials(t *testing.T) {
+	node, _ := newCanaryNode("a", map[string]string{})
+	s := newTestServer(node)
+	s.Canaries = loadCanaries(t, `[{"url": "http://example.com/", "redial": true}]`)
+
+	s.checkCanaries(node)
+	if !node.IsDraining() {
+		t.Error("node is not retired by a failed canary with redial")
+	}
+
+	if results := node.CanaryResults(); len(results) != 1 || results[0].Ok {
+		t.Errorf("canary results %+v", results)
+	}
+}
+
+func TestBlockedNodeIsNotSelected(t *testing.T) {
+	c := loadCanaries(t, `[{"url": "http://example.com/"}]`)[0]
+	blocked, _ := newCanaryNode("a", nil)
+	blocked.setCanaryResult(c, CanaryResult{Canary: c.Name})
+	other, _ := newCanaryNode("b", nil)
+	s := newTestServer(blocked, other)
+
+	for i := 0; i < 10; i++ {
+		n, f, trial := s.selectNode("http", "example.com:443")
+		if n != other {
+			t.Fatalf("%v is selected for a blocked host", n)
+		}
+		releaseSlot(n, f, trial)
+	}
+
+	if n, _, _ := s.selectNode("http", "example.org:443", "b"); n != blocked {
+		t.Errorf("node blocked for another host is not selected")
+	}
+}
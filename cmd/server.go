@@ -1,15 +1,27 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"github.com/golang/glog"
 	"github.com/gorilla/mux"
 	"github.com/hoozecn/adslproxy"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
-func ServePac(addr *net.TCPAddr) {
+// ServePac serves pac files which send requests to the proxy. With a forward
+// in the query, e.g. /pac/1.2.3.4:11280/?forward=http, the ports of the forward
+// on the host of the proxy come first in the order of node selection, each
+// skipped for the hosts its node is blocked for.
+func ServePac(addr *net.TCPAddr, s *adslproxy.Server) {
 	l, err := net.ListenTCP("tcp", addr)
 
 	if err != nil {
@@ -22,14 +34,39 @@ func ServePac(addr *net.TCPAddr) {
 		vars := mux.Vars(request)
 		proxy := vars["proxy"]
 
+		var rules strings.Builder
+		if forward := request.URL.Query().Get("forward"); forward != "" {
+			host := proxy
+			if h, _, err := net.SplitHostPort(proxy); err == nil {
+				host = h
+			}
+
+			for _, p := range s.PacProxies(forward) {
+				blocked, _ := json.Marshal(p.Blocked)
+				fmt.Fprintf(&rules, "\tif (!isBlocked(host, %s)) {\n\t\tproxies.push(\"PROXY %s\");\n\t}\n",
+					blocked, net.JoinHostPort(host, strconv.Itoa(p.Port)))
+			}
+		}
+
 		writer.Header().Set("Content-Type", "text/plain")
 		writer.WriteHeader(200)
-		writer.Write([]byte(fmt.Sprintf(`function FindProxyForURL(url, host) {
+		writer.Write([]byte(fmt.Sprintf(`function isBlocked(host, blocked) {
+	for (var i = 0; i < blocked.length; i++) {
+		if (host == blocked[i] || dnsDomainIs(host, "." + blocked[i])) {
+			return true;
+		}
+	}
+	return false;
+}
+
+function FindProxyForURL(url, host) {
 	if (shExpMatch(host, "*cdn*") || shExpMatch(host, "*.sinaimg.cn") || shExpMatch(host, "*.sinajs.cn") || shExpMatch(host, "*.cmvideo.cn")) {
 		return "DIRECT";
 	}
-	return "PROXY %s;";
-}`, proxy)))
+	var proxies = [];
+%s	proxies.push("PROXY %s");
+	return proxies.join("; ") + ";";
+}`, rules.String(), proxy)))
 	})
 
 	http.Serve(l, r)
@@ -40,6 +77,37 @@ func main() {
 	httpPort := flag.Int("httpPort", 11280, "http port")
 	pacPort := flag.Int("pacPort", 11281, "pac file port")
 	token := flag.String("token", "", "ssh token")
+	holdPeriod := flag.Int("holdPeriod", 0, "seconds to keep the ports of a disconnected node open, 0 to disable")
+	holdPolicy := flag.String("holdPolicy", adslproxy.HoldPolicyWait, "where connections to a held port go, wait or reroute")
+	portRange := flag.String("portRange", "", "range of ports assigned to forwards, e.g. 20000-20999")
+	portFile := flag.String("portFile", "", "file to keep the port assignments across restarts")
+	portKey := flag.String("portKey", adslproxy.PortKeyName, "key port assignments by node name or id")
+	bindAddrs := flag.String("bindAddrs", "", "comma separated IPs which forwards may listen on, any if empty")
+	bindPortRange := flag.String("bindPortRange", "", "range of ports which forwards may listen on, e.g. 20000-20999")
+	maxForwards := flag.Int("maxForwards", 0, "max number of forwards per node, 0 for unlimited")
+	forwardNames := flag.String("forwardNames", "", "comma separated names of forwards which may be registered, any if empty")
+	acl := flag.String("acl", "", "json file of client allowlists, reloaded on SIGHUP")
+	nodeLabels := flag.String("nodeLabels", "", "json file of the labels of nodes by name, which select label allowlists and limits")
+	consumers := flag.String("consumers", "", "json file of consumer accounts, proxy authentication is enforced by server if set")
+	usageFile := flag.String("usageFile", "", "file to keep the usages of consumers across restarts")
+	adminToken := flag.String("adminToken", "", "bearer token of the consumer and usage apis, which are served to localhost only if empty")
+	authForwards := flag.String("authForwards", "http,socks5", "comma separated names of forwards authenticated by server")
+	accessLog := flag.String("accessLog", "", "file of the access log in json lines")
+	accessLogSize := flag.Int64("accessLogSize", 100<<20, "max bytes of the access log before it is rotated")
+	accessLogBackups := flag.Int("accessLogBackups", 5, "number of rotated access logs to keep")
+	maxNodeConns := flag.Int("maxNodeConns", 0, "max concurrent connections per node, 0 for unlimited")
+	maxForwardConns := flag.Int("maxForwardConns", 0, "max concurrent connections per forward, 0 for unlimited")
+	connQueueTimeout := flag.Int("connQueueTimeout", 0, "milliseconds a connection waits for a full node before it is refused")
+	reportThreshold := flag.Int("reportThreshold", 0, "bad ip reports in the window which make a node redial, 0 to disable")
+	reportWindow := flag.Int("reportWindow", 600, "seconds of the sliding window of bad ip reports")
+	canaries := flag.String("canaries", "", "json file of canary urls checked through every node")
+	canaryInterval := flag.Int("canaryInterval", 300, "seconds between canary checks")
+	breakerFailures := flag.Int("breakerFailures", 5, "consecutive dial failures which eject a node from reroute selection, 0 to disable")
+	breakerBackoff := flag.Int("breakerBackoff", 30, "seconds a node is ejected before a trial connection")
+	breakerMaxBackoff := flag.Int("breakerMaxBackoff", 600, "max seconds a node is ejected after failed trials")
+	dialRetries := flag.Int("dialRetries", 2, "number of other nodes a connection is retried on when dialing fails")
+	eventHook := flag.String("eventHook", "", "url which node events are posted to as json")
+	drainTimeout := flag.Int("drainTimeout", 30, "max seconds to wait for active connections in a graceful redial")
 
 	flag.Set("logtostderr", "true")
 	flag.Parse()
@@ -48,10 +116,141 @@ func main() {
 	httpAddr, _ := net.ResolveTCPAddr("tcp", fmt.Sprintf("[::]:%d", *httpPort))
 	pacAddr, _ := net.ResolveTCPAddr("tcp", fmt.Sprintf("[::]:%d", *pacPort))
 
-	go func() {
-		ServePac(pacAddr)
-	}()
-
 	s := adslproxy.NewServer(sshAddr, httpAddr, *token)
+	s.DrainTimeout = time.Duration(*drainTimeout) * time.Second
+	s.HoldPeriod = time.Duration(*holdPeriod) * time.Second
+	s.HoldPolicy = *holdPolicy
+	s.PortKey = *portKey
+	s.MaxNodeConns = *maxNodeConns
+	s.MaxForwardConns = *maxForwardConns
+	s.ConnQueueTimeout = time.Duration(*connQueueTimeout) * time.Millisecond
+	s.ReportThreshold = *reportThreshold
+	s.ReportWindow = time.Duration(*reportWindow) * time.Second
+	s.CanaryInterval = time.Duration(*canaryInterval) * time.Second
+	s.BreakerFailures = *breakerFailures
+	s.BreakerBackoff = time.Duration(*breakerBackoff) * time.Second
+	s.BreakerMaxBackoff = time.Duration(*breakerMaxBackoff) * time.Second
+	s.Events.Hook = *eventHook
+	s.DialRetries = *dialRetries
+	s.AdminToken = *adminToken
+
+	if *nodeLabels != "" {
+		var err error
+		s.NodeLabels, err = adslproxy.LoadNodeLabels(*nodeLabels)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if *canaries != "" {
+		var err error
+		s.Canaries, err = adslproxy.LoadCanaries(*canaries)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if *portRange != "" {
+		minPort, maxPort, err := adslproxy.ParsePortRange(*portRange)
+		if err != nil {
+			panic(err)
+		}
+
+		s.PortAllocator, err = adslproxy.NewPortAllocator(minPort, maxPort, *portFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if *bindAddrs != "" || *bindPortRange != "" || *maxForwards > 0 || *forwardNames != "" {
+		policy := &adslproxy.BindPolicy{MaxForwards: *maxForwards}
+
+		for _, addr := range splitList(*bindAddrs) {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				panic(fmt.Sprintf("illegal bind address %s", addr))
+			}
+			policy.AllowedAddrs = append(policy.AllowedAddrs, ip)
+		}
+
+		if *bindPortRange != "" {
+			var err error
+			policy.MinPort, policy.MaxPort, err = adslproxy.ParsePortRange(*bindPortRange)
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		policy.AllowedNames = splitList(*forwardNames)
+		s.BindPolicy = policy
+	}
+
+	if *acl != "" {
+		var err error
+		s.AccessList, err = adslproxy.NewAccessList(*acl)
+		if err != nil {
+			panic(err)
+		}
+
+		go ReloadWhenSignaled(s.AccessList)
+	}
+
+	if *consumers != "" {
+		var err error
+		s.Consumers, err = adslproxy.NewConsumerStore(*consumers)
+		if err != nil {
+			panic(err)
+		}
+
+		s.AuthForwards = splitList(*authForwards)
+
+		s.Usage, err = adslproxy.NewUsageTracker(*usageFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if *accessLog != "" {
+		var err error
+		s.AccessLog, err = adslproxy.NewAccessLog(*accessLog, *accessLogSize, *accessLogBackups)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	go ServePac(pacAddr, s)
+	go StopWhenSignaled(s)
+
 	s.Start()
 }
+
+// StopWhenSignaled stops the server on SIGINT or SIGTERM, the usages are saved before it exits
+func StopWhenSignaled(s *adslproxy.Server) {
+	stopChan := make(chan os.Signal, 1)
+	signal.Notify(stopChan, syscall.SIGINT, syscall.SIGTERM)
+
+	<-stopChan
+	s.Stop()
+}
+
+// ReloadWhenSignaled reloads the access list on SIGHUP
+func ReloadWhenSignaled(acl *adslproxy.AccessList) {
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+
+	for range reloadChan {
+		if err := acl.Reload(); err != nil {
+			glog.Errorf("failed to reload access list %s", err)
+		}
+	}
+}
+
+func splitList(s string) (list []string) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
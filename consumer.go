@@ -0,0 +1,172 @@
+package adslproxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Consumer is an account which is allowed to use the proxies of the server
+type Consumer struct {
+	Name     string   `json:"name"`
+	Password string   `json:"password"`
+	ApiKeys  []string `json:"api_keys"`
+	Disabled bool     `json:"disabled"`
+
+	// DailyQuota and MonthlyQuota limit the bytes in both directions, 0 for unlimited
+	DailyQuota   int64 `json:"daily_quota"`
+	MonthlyQuota int64 `json:"monthly_quota"`
+	// MaxConns limits the concurrent connections, 0 for unlimited
+	MaxConns int `json:"max_conns"`
+}
+
+func secretEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// ConsumerStore keeps the consumers of the server. If a path is given, the
+// consumers are loaded from and saved to it.
+type ConsumerStore struct {
+	path      string
+	lock      sync.RWMutex
+	consumers map[string]*Consumer
+}
+
+func NewConsumerStore(path string) (*ConsumerStore, error) {
+	cs := &ConsumerStore{
+		path:      path,
+		consumers: make(map[string]*Consumer),
+	}
+
+	if path == "" {
+		return cs, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cs, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var consumers []*Consumer
+	if err := json.Unmarshal(data, &consumers); err != nil {
+		return nil, errors.Wrapf(err, "failed to load consumers from %s", path)
+	}
+
+	for _, c := range consumers {
+		cs.consumers[c.Name] = c
+	}
+
+	glog.Infof("%d consumers are loaded from %s", len(consumers), path)
+	return cs, nil
+}
+
+// Authenticate returns the consumer of the credential. The password is
+// checked against the consumer of the username first, then it is taken as
+// an api key of any consumer. An api key may also be given as the username
+// with an empty password.
+func (cs *ConsumerStore) Authenticate(username, password string) *Consumer {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+
+	if c, ok := cs.consumers[username]; ok && !c.Disabled && c.Password != "" && secretEqual(c.Password, password) {
+		return c
+	}
+
+	key := password
+	if key == "" {
+		key = username
+	}
+
+	if key == "" {
+		return nil
+	}
+
+	for _, c := range cs.consumers {
+		if c.Disabled {
+			continue
+		}
+
+		for _, apiKey := range c.ApiKeys {
+			if secretEqual(apiKey, key) {
+				return c
+			}
+		}
+	}
+
+	return nil
+}
+
+func (cs *ConsumerStore) Get(name string) *Consumer {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+
+	return cs.consumers[name]
+}
+
+// Put creates or replaces the consumer, which is how credentials are rotated
+func (cs *ConsumerStore) Put(c *Consumer) error {
+	if c.Name == "" {
+		return errors.New("name of consumer is empty")
+	}
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	cs.consumers[c.Name] = c
+	return cs.save()
+}
+
+func (cs *ConsumerStore) Remove(name string) error {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	delete(cs.consumers, name)
+	return cs.save()
+}
+
+func (cs *ConsumerStore) List() []*Consumer {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+
+	list := make([]*Consumer, 0, len(cs.consumers))
+	for _, c := range cs.consumers {
+		list = append(list, c)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	return list
+}
+
+// save writes the consumers to the file, must be called with the lock held
+func (cs *ConsumerStore) save() error {
+	if cs.path == "" {
+		return nil
+	}
+
+	list := make([]*Consumer, 0, len(cs.consumers))
+	for _, c := range cs.consumers {
+		list = append(list, c)
+	}
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	tmp := cs.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(os.Rename(tmp, cs.path))
+}
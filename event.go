@@ -0,0 +1,92 @@
+package adslproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/golang/glog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	EventNodeEjected   = "node_ejected"
+	EventNodeHalfOpen  = "node_half_open"
+	EventNodeRecovered = "node_recovered"
+)
+
+// Event is something that happened to a node
+type Event struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	NodeId   string    `json:"node_id"`
+	NodeName string    `json:"node_name"`
+	Ip       string    `json:"ip"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// EventLog keeps the latest events in memory. If Hook is set, every event is
+// posted to it as json.
+type EventLog struct {
+	MaxEvents int
+	Hook      string
+
+	lock   sync.Mutex
+	events []Event
+}
+
+func NewEventLog(maxEvents int) *EventLog {
+	return &EventLog{MaxEvents: maxEvents}
+}
+
+func (l *EventLog) Emit(eventType string, node *Node, reason string) {
+	e := Event{
+		Time:     time.Now(),
+		Type:     eventType,
+		NodeId:   node.Id,
+		NodeName: node.Name,
+		Ip:       node.RemoteIp,
+		Reason:   reason,
+	}
+
+	glog.Infof("event %s of %s %s", eventType, node, reason)
+
+	l.lock.Lock()
+	l.events = append(l.events, e)
+	if l.MaxEvents > 0 && len(l.events) > l.MaxEvents {
+		l.events = l.events[len(l.events)-l.MaxEvents:]
+	}
+	l.lock.Unlock()
+
+	if l.Hook != "" {
+		go l.post(e)
+	}
+}
+
+func (l *EventLog) post(e Event) {
+	data, _ := json.Marshal(e)
+	client := &http.Client{Timeout: EventHookTimeout}
+
+	resp, err := client.Post(l.Hook, "application/json", bytes.NewReader(data))
+	if err != nil {
+		glog.Errorf("failed to post event %s %s", e.Type, err)
+		return
+	}
+
+	resp.Body.Close()
+}
+
+// List returns the events after since
+func (l *EventLog) List(since time.Time) []Event {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	list := make([]Event, 0, len(l.events))
+	for _, e := range l.events {
+		if e.Time.After(since) {
+			list = append(list, e)
+		}
+	}
+
+	return list
+}
@@ -0,0 +1,112 @@
+package adslproxy
+
+import (
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ipEchoLimit is the max bytes of a response of the ip echo url
+const ipEchoLimit = 256
+
+// maxReportedAttempts is the number of the latest attempts kept for the report of a redial
+const maxReportedAttempts = 20
+
+// ExitIp fetches the exit ip from IpEchoUrl, which returns the ip of the client as plain text
+func (ac *AdslConfig) ExitIp() (string, error) {
+	client := &http.Client{Timeout: IpEchoTimeout}
+	resp, err := client.Get(ac.IpEchoUrl)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, ipEchoLimit))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("ip echo returns %d", resp.StatusCode)
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(string(data)))
+	if ip == nil {
+		return "", errors.Errorf("illegal ip from ip echo %q", data)
+	}
+
+	return ip.String(), nil
+}
+
+// waitExitIp polls the exit ip until the line is back or VerifyTimeout is over
+func (ac *AdslConfig) waitExitIp() (string, error) {
+	deadline := time.Now().Add(ac.VerifyTimeout)
+	for {
+		ip, err := ac.ExitIp()
+		if err == nil || time.Now().After(deadline) {
+			return ip, err
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// RedialVerified redials until the exit ip is changed, in at most
+// MaxRedialAttempts if the ip stays the same. A failed redial or a line which
+// doesn't come back is retried every RedialInterval. The ip is not checked if
+// IpEchoUrl is empty, or the ip before the redial is not got from it, since
+// an ip from any other source is not comparable. PreviousIp is set to the ip
+// got before the redial, or cleared if there is none. Must be called with the
+// redial lock held.
+func (ac *AdslConfig) RedialVerified() []RedialAttempt {
+	var previous string
+	if ac.IpEchoUrl != "" {
+		ip, err := ac.ExitIp()
+		if err != nil {
+			glog.Errorf("failed to get exit ip before redial, it is not checked to be changed %s", err)
+		}
+		previous = ip
+	}
+
+	var attempts []RedialAttempt
+	for unchanged := 0; ; {
+		attempt := RedialAttempt{Time: time.Now(), PreviousIp: previous}
+
+		ac.PreviousIp = previous
+		err := ac.Redial()
+		if err == nil && ac.IpEchoUrl != "" {
+			attempt.Ip, err = ac.waitExitIp()
+		}
+
+		attempt.Duration = int64(time.Since(attempt.Time) / time.Millisecond)
+		if err != nil {
+			attempt.Error = err.Error()
+		}
+		attempts = append(attempts, attempt)
+		if len(attempts) > maxReportedAttempts {
+			attempts = attempts[1:]
+		}
+
+		if err != nil {
+			glog.Errorf("failed to redial %s", err)
+			time.Sleep(ac.RedialInterval)
+			continue
+		}
+
+		if previous != "" && attempt.Ip == previous {
+			if unchanged++; unchanged < ac.MaxRedialAttempts {
+				glog.Infof("exit ip %s is not changed by redial, try again", previous)
+				continue
+			}
+
+			glog.Errorf("exit ip %s is not changed after %d redials", previous, unchanged)
+		}
+
+		return attempts
+	}
+}
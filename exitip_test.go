@@ -0,0 +1,82 @@
+package adslproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newVerifiedConfig(line *fakeLine, url string) *AdslConfig {
+	return &AdslConfig{
+		PreviousIp:        "192.168.1.10",
+		IpEchoUrl:         url,
+		MaxRedialAttempts: 3,
+		VerifyTimeout:     time.Second,
+		RedialInterval:    time.Millisecond,
+		Redialer:          line,
+	}
+}
+
+func TestRedialVerified(t *testing.T) {
+	line := &fakeLine{ips: []string{"1.1.1.1", "1.1.1.1", "2.2.2.2"}}
+	server := httptest.NewServer(line)
+	defer server.Close()
+
+	ac := newVerifiedConfig(line, server.URL)
+	attempts := ac.RedialVerified()
+
+	// the ip before the redial is from ip echo, not the interface address
+	if len(attempts) != 2 || attempts[0].PreviousIp != "1.1.1.1" || attempts[1].Ip != "2.2.2.2" {
+		t.Errorf("attempts %+v", attempts)
+	}
+
+	// the redialer gets the ip from ip echo instead of the stale one
+	if len(line.previousIps) != 2 || line.previousIps[0] != "1.1.1.1" || line.previousIps[1] != "1.1.1.1" {
+		t.Errorf("previous ips of redials %v", line.previousIps)
+	}
+}
+
+func TestRedialVerifiedUnchanged(t *testing.T) {
+	line := &fakeLine{ips: []string{"1.1.1.1", "1.1.1.1", "1.1.1.1", "1.1.1.1"}}
+	server := httptest.NewServer(line)
+	defer server.Close()
+
+	if attempts := newVerifiedConfig(line, server.URL).RedialVerified(); len(attempts) != 3 {
+		t.Errorf("%d attempts, MaxRedialAttempts is 3", len(attempts))
+	}
+}
+
+func TestRedialNotVerified(t *testing.T) {
+	line := &fakeLine{}
+	ac := newVerifiedConfig(line, "")
+
+	// the interface address is not compared without ip echo
+	attempts := ac.RedialVerified()
+	if len(attempts) != 1 || attempts[0].PreviousIp != "" || attempts[0].Ip != "" {
+		t.Errorf("attempts %+v", attempts)
+	}
+
+	if len(line.previousIps) != 1 || line.previousIps[0] != "" {
+		t.Errorf("previous ips of redials %v", line.previousIps)
+	}
+}
+
+func TestExitIp(t *testing.T) {
+	body := "not an ip"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	defer server.Close()
+
+	ac := &AdslConfig{IpEchoUrl: server.URL}
+	if _, err := ac.ExitIp(); err == nil {
+		t.Error("illegal ip is accepted")
+	}
+
+	body = " 2001:db8::1\n"
+	if ip, err := ac.ExitIp(); err != nil || ip != "2001:db8::1" {
+		t.Errorf("exit ip %s %v", ip, err)
+	}
+}
@@ -0,0 +1,623 @@
+package adslproxy
+
+import (
+	"github.com/gocloudio/crypto/ssh"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ForwardedTcpIpChannel is the type of channel opened to the agent for every
+// connection accepted on a forward listener
+const ForwardedTcpIpChannel = "forwarded-tcpip"
+
+const (
+	// HoldPolicyWait keeps incoming connections until the node is back
+	HoldPolicyWait = "wait"
+	// HoldPolicyReroute sends incoming connections to another node with a forward of the same name
+	HoldPolicyReroute = "reroute"
+)
+
+// forwardedTcpIpPayload is the extra data of a forwarded-tcpip channel (RFC 4254 7.2)
+type forwardedTcpIpPayload struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// pipe copies data between both ends and returns when either of them is
+// broken. leftClosed is true if the copy from left is finished first.
+func pipe(left, right io.ReadWriter) (leftClosed bool) {
+	chDone := make(chan bool, 2)
+
+	cp := func(to io.Writer, from io.Reader, fromLeft bool) {
+		// if either end breaks, the caller closes both ends to ensure they're
+		// both unblocked, otherwise io.Copy can block forever if e.g. reading
+		// after write end has gone away
+		defer func() {
+			chDone <- fromLeft
+		}()
+
+		_, _ = io.Copy(to, from)
+	}
+
+	go cp(left, right, false)
+	go cp(right, left, true)
+
+	return <-chDone
+}
+
+// openForwardChannel opens a channel to the agent on behalf of a connection
+// accepted on the forward
+func (n *Node) openForwardChannel(f *Forward, origin net.Addr) (ssh.Channel, error) {
+	payload := forwardedTcpIpPayload{
+		Addr: f.tunnelAddr.IP.String(),
+		Port: uint32(f.tunnelAddr.Port),
+	}
+
+	if host, port, err := net.SplitHostPort(origin.String()); err == nil {
+		p, _ := strconv.Atoi(port)
+		payload.OriginAddr = host
+		payload.OriginPort = uint32(p)
+	}
+
+	channel, reqs, err := n.conn.OpenChannel(ForwardedTcpIpChannel, ssh.Marshal(&payload))
+	if err != nil {
+		return nil, err
+	}
+
+	go ssh.DiscardRequests(reqs)
+	return channel, nil
+}
+
+// forwardPort is a listener owned by the server. It outlives the ssh session
+// of the node so that the port can be held while the node is redialing.
+type forwardPort struct {
+	listener *net.TCPListener
+	// nodeId and name identify the forward which the port belongs to
+	nodeId string
+	name   string
+
+	lock    sync.Mutex
+	node    *Node
+	forward *Forward
+	// bound is closed when a forward is bound to the port
+	bound chan bool
+	// closed is closed when the port is released
+	closed chan bool
+	expire *time.Timer
+}
+
+// portKey is the key of the port of a forward, owner is the node id or name
+// which the ports are held and assigned by, see Server.portOwner
+func portKey(owner, name string) string {
+	return owner + "/" + name
+}
+
+func newForwardPort(listener *net.TCPListener, nodeId, name string) *forwardPort {
+	return &forwardPort{
+		listener: listener,
+		nodeId:   nodeId,
+		name:     name,
+		bound:    make(chan bool),
+		closed:   make(chan bool),
+	}
+}
+
+func (p *forwardPort) bind(node *Node, f *Forward, listener *net.TCPListener) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.listener = listener
+	p.nodeId = node.Id
+	if p.expire != nil {
+		p.expire.Stop()
+		p.expire = nil
+	}
+
+	p.node = node
+	p.forward = f
+	close(p.bound)
+}
+
+// unbind detaches the forward from the port, the port is held until the timer fires
+func (p *forwardPort) unbind(hold time.Duration, expire func()) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.node = nil
+	p.forward = nil
+	p.bound = make(chan bool)
+	p.expire = time.AfterFunc(hold, expire)
+}
+
+func (p *forwardPort) target() (*Node, *Forward, chan bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.node, p.forward, p.bound
+}
+
+func (p *forwardPort) isHeld() bool {
+	node, _, _ := p.target()
+	return node == nil
+}
+
+func (p *forwardPort) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.expire != nil {
+		p.expire.Stop()
+	}
+
+	select {
+	case <-p.closed:
+	default:
+		close(p.closed)
+	}
+
+	p.listener.Close()
+}
+
+// bindForward binds a forward registered by the node to its port. If the port
+// of the forward is held since the last session of its owner, it is reused.
+// Nodes of the same owner which are connected at the same time share no port,
+// the forward of the later one is keyed by its id and listens on the port
+// requested by agent.
+func (s *Server) bindForward(node *Node, f *Forward, listener *net.TCPListener, held *forwardPort) {
+	owner := s.portOwner(node)
+	if held != nil {
+		if held.listener.Addr().String() != listener.Addr().String() {
+			l, err := net.ListenTCP("tcp", held.listener.Addr().(*net.TCPAddr))
+			if err != nil {
+				glog.Errorf("failed to reopen held port %s of %s %s", held.listener.Addr(), f, err)
+				held.close()
+				held = nil
+			} else {
+				listener.Close()
+				listener = l
+			}
+		}
+	}
+
+	if held == nil && s.isPortBound(owner, f.Name) {
+		glog.Errorf("port of %s is bound by another node of %s, the port requested by agent is used", f, owner)
+		owner = node.Id
+	} else if held == nil && s.PortAllocator != nil {
+		l, err := s.listenAssignedPort(owner, f, listener)
+		if err != nil {
+			glog.Errorf("failed to assign port to %s, the port requested by agent is used %s", f, err)
+		} else if l != listener {
+			listener.Close()
+			listener = l
+		}
+	}
+
+	port := held
+	if port == nil {
+		port = newForwardPort(listener, node.Id, f.Name)
+	}
+
+	f.Left = listener.Addr().(*net.TCPAddr)
+
+	s.portOps.Lock()
+	s.ports[portKey(owner, f.Name)] = port
+	s.portOps.Unlock()
+
+	port.bind(node, f, listener)
+	go s.servePort(port, listener)
+
+	if held != nil {
+		glog.Infof("held port %s is bound to %s again", listener.Addr(), f)
+	}
+}
+
+// isPortBound tells if the port of the forward is bound to a connected node
+func (s *Server) isPortBound(owner, name string) bool {
+	s.portOps.Lock()
+	defer s.portOps.Unlock()
+
+	port, ok := s.ports[portKey(owner, name)]
+	return ok && !port.isHeld()
+}
+
+// takeHeldPort removes the held port of the forward from the server and
+// releases its listener so that the agent is able to bind the same address
+func (s *Server) takeHeldPort(owner, name string) *forwardPort {
+	s.portOps.Lock()
+	defer s.portOps.Unlock()
+
+	key := portKey(owner, name)
+	port, ok := s.ports[key]
+	if !ok || !port.isHeld() {
+		return nil
+	}
+
+	delete(s.ports, key)
+	port.listener.Close()
+	return port
+}
+
+// releaseForwards is called when the node is disconnected. The ports of its
+// forwards are held for HoldPeriod, or closed if holding is disabled.
+func (s *Server) releaseForwards(node *Node) {
+	s.portOps.Lock()
+	defer s.portOps.Unlock()
+
+	for key, port := range s.ports {
+		n, f, _ := port.target()
+		if n != node {
+			continue
+		}
+
+		key, port := key, port
+
+		if s.HoldPeriod <= 0 || s.stopped {
+			delete(s.ports, key)
+			port.close()
+			continue
+		}
+
+		glog.Infof("port %s of %s is held for %s", port.listener.Addr(), f, s.HoldPeriod)
+		port.unbind(s.HoldPeriod, func() {
+			s.expirePort(key, port)
+		})
+	}
+}
+
+func (s *Server) expirePort(key string, port *forwardPort) {
+	s.portOps.Lock()
+	defer s.portOps.Unlock()
+
+	if s.ports[key] == port && port.isHeld() {
+		delete(s.ports, key)
+		port.close()
+		glog.Infof("held port %s is released", port.listener.Addr())
+	}
+}
+
+func (s *Server) closePorts() {
+	s.portOps.Lock()
+	defer s.portOps.Unlock()
+
+	for key, port := range s.ports {
+		delete(s.ports, key)
+		port.close()
+	}
+}
+
+// servePort accepts connections on the listener until it is closed
+func (s *Server) servePort(p *forwardPort, l *net.TCPListener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			glog.V(2).Infof("port %s is closed %s", l.Addr(), err)
+			return
+		}
+
+		go s.handlePortConn(p, conn)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// selectNode picks a node which has a forward of the given name and a free
+// connection slot, weighted by its score and how busy it is. The slot is
+// acquired for the caller, and reported if it is the trial connection of the
+// node. Nodes blocked for the target, which may be empty, and the excluded
+// nodes are skipped.
+func (s *Server) selectNode(name, target string, exclude ...string) (*Node, *Forward, bool) {
+	type candidate struct {
+		node    *Node
+		forward *Forward
+	}
+
+	var candidates []candidate
+	var weights []float64
+	for _, n := range s.ListNodes() {
+		if containsString(exclude, n.Id) || n.IsDraining() || n.IsBlocked(target) {
+			continue
+		}
+
+		for _, f := range n.ForwardList {
+			if f.Name == name {
+				candidates = append(candidates, candidate{n, f})
+				weights = append(weights, s.nodeWeight(n))
+			}
+		}
+	}
+
+	weightedOrder(len(candidates), func(i int) float64 {
+		return weights[i]
+	}, func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+		weights[i], weights[j] = weights[j], weights[i]
+	})
+
+	for _, c := range candidates {
+		if admitted, trial := s.admit(c.node, c.forward); admitted {
+			return c.node, c.forward, trial
+		}
+	}
+
+	return nil, nil, false
+}
+
+// nodeWeight is the weight of the node in selection, its score shared by its connections
+func (s *Server) nodeWeight(n *Node) float64 {
+	return n.Score(s.ReportWindow).Score / float64(1+n.ActiveConns())
+}
+
+// PacProxy is a port of a forward offered in pac files
+type PacProxy struct {
+	Port int
+	// Blocked are the hosts which the node of the port is blocked for
+	Blocked []string
+}
+
+// PacProxies returns the ports of the forwards of the name for pac files, in
+// the order of selection without the randomness. Draining nodes and nodes
+// ejected by their breakers are left out.
+func (s *Server) PacProxies(name string) []PacProxy {
+	weights := make(map[int]float64)
+	var proxies []PacProxy
+	for _, n := range s.ListNodes() {
+		if n.IsDraining() || n.breaker.State() == BreakerOpen {
+			continue
+		}
+
+		for _, f := range n.ForwardList {
+			if f.Name == name && f.Left != nil {
+				proxies = append(proxies, PacProxy{Port: f.Left.Port, Blocked: n.BlockedHosts()})
+				weights[f.Left.Port] = s.nodeWeight(n)
+			}
+		}
+	}
+
+	sort.SliceStable(proxies, func(i, j int) bool {
+		return weights[proxies[i].Port] > weights[proxies[j].Port]
+	})
+
+	return proxies
+}
+
+// queueSlot waits up to ConnQueueTimeout for a free connection slot on the node
+func (s *Server) queueSlot(node *Node, f *Forward) bool {
+	deadline := time.Now().Add(s.ConnQueueTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(ConnQueueCheckInterval)
+		if node.tryAcquire(f, s.MaxNodeConns, s.MaxForwardConns) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolvePort finds the node which a connection accepted on the port is sent
+// to, and acquires a connection slot on it
+func (s *Server) resolvePort(p *forwardPort) (*Node, *Forward, bool) {
+	node, f, bound := p.target()
+
+	if node == nil && s.HoldPolicy != HoldPolicyReroute {
+		timer := time.NewTimer(s.HoldPeriod)
+		defer timer.Stop()
+
+		select {
+		case <-bound:
+			node, f, _ = p.target()
+		case <-p.closed:
+		case <-timer.C:
+		}
+	}
+
+	if node != nil && !node.IsDraining() {
+		if s.HoldPolicy == HoldPolicyReroute {
+			if admitted, trial := s.admit(node, f); admitted {
+				return node, f, trial
+			}
+		} else if node.tryAcquire(f, s.MaxNodeConns, s.MaxForwardConns) || s.queueSlot(node, f) {
+			return node, f, false
+		}
+	}
+
+	if s.HoldPolicy == HoldPolicyReroute {
+		return s.selectNode(p.name, "", p.nodeId)
+	}
+
+	return nil, nil, false
+}
+
+func (s *Server) handlePortConn(p *forwardPort, conn net.Conn) {
+	defer conn.Close()
+
+	client := &meter{ReadWriter: conn}
+	entry := &AccessLogEntry{
+		Time:    time.Now(),
+		Client:  conn.RemoteAddr().String(),
+		Forward: p.name,
+	}
+	defer s.AccessLog.finish(entry, client)
+
+	// the client is checked before it waits for a held port
+	if !s.AccessList.Admits(conn.RemoteAddr()) {
+		glog.Infof("connection from %s to port %s is denied by access list", conn.RemoteAddr(), p.listener.Addr())
+		entry.Reason = "denied by access list"
+		return
+	}
+
+	node, f, trial := s.resolvePort(p)
+	if node == nil {
+		glog.V(2).Infof("no node available for port %s, connection from %s is refused", p.listener.Addr(), conn.RemoteAddr())
+		entry.Reason = "no node available"
+		return
+	}
+	defer func() {
+		releaseSlot(node, f, trial)
+	}()
+
+	entry.NodeId = node.Id
+	entry.ExitIp = node.RemoteIp
+
+	if !s.AccessList.Allowed(conn.RemoteAddr(), node) {
+		glog.Infof("connection from %s to %s of %s is denied by access list", conn.RemoteAddr(), f, node)
+		entry.Reason = "denied by access list"
+		return
+	}
+
+	var session *proxySession
+	if s.requiresAuth(f.Name) {
+		var err error
+		if session, err = s.authenticateProxy(conn); err != nil {
+			glog.Infof("proxy authentication of %s on %s failed %s", conn.RemoteAddr(), f, err)
+			entry.Reason = err.Error()
+			return
+		}
+
+		entry.Consumer = session.Consumer.Name
+		entry.Target = session.Target
+
+	}
+
+	// reroute moves the connection to another node with a forward of the same name
+	reroute := func(exclude ...string) bool {
+		n, nf, ntrial := s.selectNode(p.name, entry.Target, exclude...)
+		if n == nil {
+			return false
+		}
+
+		if !s.AccessList.Allowed(conn.RemoteAddr(), n) {
+			releaseSlot(n, nf, ntrial)
+			return false
+		}
+
+		glog.V(2).Infof("connection from %s is rerouted from %s to %s", conn.RemoteAddr(), node, n)
+		releaseSlot(node, f, trial)
+		node, f, trial = n, nf, ntrial
+		entry.NodeId = node.Id
+		entry.ExitIp = node.RemoteIp
+		return true
+	}
+
+	if session != nil && s.HoldPolicy == HoldPolicyReroute && node.IsBlocked(session.Target) {
+		glog.V(2).Infof("%s is blocked for %s", node, session.Target)
+		reroute(node.Id)
+	}
+
+	if session != nil && s.Usage != nil {
+		defer s.Usage.Release(session.Consumer)
+	}
+
+	// nothing is sent to the client until connectNode succeeds, so a failed
+	// connection is retried on other nodes whatever the hold policy is, as long
+	// as the handshake can be replayed. A plain http request with a body is not,
+	// since the body is streamed from the client. A connection not authenticated
+	// by server is retried only if the channel fails to open, its handshake goes
+	// to the agent as is and a failure of the agent is found out too late.
+	tried := []string{node.Id}
+	channel, reply, err := s.connectNode(node, f, conn, session)
+	for err != nil {
+		glog.Errorf("failed to connect %s of %s for %s %s", f, node, conn.RemoteAddr(), err)
+		entry.Reason = err.Error()
+
+		if len(tried) > s.DialRetries || (session != nil && !session.replayable) || !reroute(tried...) {
+			return
+		}
+
+		tried = append(tried, node.Id)
+		channel, reply, err = s.connectNode(node, f, conn, session)
+	}
+	defer channel.Close()
+
+	if session != nil && s.Usage != nil {
+		s.Usage.Request(session.Consumer)
+	}
+
+	var consumer *Consumer
+	var sniffer *targetSniffer
+	if session != nil {
+		consumer = session.Consumer
+	} else {
+		// the handshake of the client goes to the agent as is, the target is found on the way
+		sniffer = &targetSniffer{ReadWriter: conn}
+		client.ReadWriter = sniffer
+		defer func() {
+			entry.Target = sniffer.Target()
+		}()
+	}
+
+	// the traffic is accounted as it flows, so a connection is cut once the consumer is over its quota
+	metered := s.Usage.wrap(client, consumer)
+	if session != nil {
+		client.ReadWriter = session
+		if _, err := metered.Write(reply); err != nil {
+			entry.Reason = "client closed"
+			return
+		}
+	}
+
+	entry.Reason = closeReason(pipe(s.Throttle.wrap(metered, connScopes(node, f, consumer)...), channel))
+	if consumer != nil && s.Usage != nil {
+		if err := s.Usage.Exceeded(consumer); err != nil {
+			entry.Reason = err.Error()
+		}
+	}
+
+	// a dial failure of agent is reported separately, data from agent means the dial succeeded
+	if _, down := client.counts(); down > 0 {
+		s.dialSucceeded(node)
+	}
+}
+
+// connectNode opens a channel to the forward of the node for the connection.
+// If the client is authenticated by the server, its handshake is replayed and
+// the first byte of the reply is read, so that a failure of the agent to reach
+// its proxy is found before anything is sent to the client.
+func (s *Server) connectNode(node *Node, f *Forward, conn net.Conn, session *proxySession) (ssh.Channel, []byte, error) {
+	channel, err := node.openForwardChannel(f, conn.RemoteAddr())
+	if err != nil {
+		s.dialFailed(node, "failed to open channel "+err.Error())
+		return nil, nil, errors.Wrap(err, "failed to open channel")
+	}
+
+	if session == nil {
+		return channel, nil, nil
+	}
+
+	if err := session.replay(channel); err != nil {
+		channel.Close()
+		return nil, nil, errors.Wrap(err, "failed to replay handshake")
+	}
+
+	reply := make([]byte, 1)
+	if _, err := io.ReadFull(channel, reply); err != nil {
+		channel.Close()
+		return nil, nil, errors.Wrap(err, "no reply from proxy of agent")
+	}
+
+	return channel, reply, nil
+}
+
+// closeReason describes which end of a proxied connection is closed first
+func closeReason(clientClosed bool) string {
+	if clientClosed {
+		return "client closed"
+	}
+
+	return "agent closed"
+}
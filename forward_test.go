@@ -0,0 +1,196 @@
+package adslproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRetryOnAnotherNode(t *testing.T) {
+	for _, c := range []struct {
+		policy  string
+		retries int
+	}{{HoldPolicyReroute, 0}, {HoldPolicyReroute, 1}, {HoldPolicyWait, 0}, {HoldPolicyWait, 1}} {
+		retries := c.retries
+		s := newTestServer()
+		s.HoldPolicy = c.policy
+		s.DialRetries = retries
+
+		// the agent of a fails to reach its proxy, b echoes
+		_, f := newBoundNode(t, s, "a", "http", nil)
+		newBoundNode(t, s, "b", "http", func(conn net.Conn) {
+			io.Copy(conn, conn)
+			conn.Close()
+		})
+
+		conn, err := net.Dial("tcp", f.Left.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("ping"))
+		reply := make([]byte, 4)
+		_, err = io.ReadFull(conn, reply)
+		conn.Close()
+
+		if retries == 0 && err == nil {
+			t.Errorf("connection is retried with no retries under %s", c.policy)
+		}
+
+		if retries == 1 && string(reply) != "ping" {
+			t.Errorf("connection is not retried on b under %s %q %v", c.policy, reply, err)
+		}
+
+		s.closePorts()
+	}
+}
+
+func TestHoldPortUntilNodeIsBack(t *testing.T) {
+	s := newTestServer()
+	s.HoldPeriod = time.Minute
+	s.HoldPolicy = HoldPolicyWait
+
+	node, f := newBoundNode(t, s, "a", "http", nil)
+	addr := f.Left.String()
+
+	s.releaseForwards(node)
+	p := s.ports[portKey("a", "http")]
+	if p == nil || !p.isHeld() {
+		t.Fatal("port is not held")
+	}
+
+	resolved := make(chan *Node, 1)
+	go func() {
+		n, f, _ := s.resolvePort(p)
+		if n != nil {
+			n.release(f)
+		}
+		resolved <- n
+	}()
+
+	// the node is back and gets the same port
+	time.Sleep(50 * time.Millisecond)
+	held := s.takeHeldPort("a", "http")
+	if held != p {
+		t.Fatal("held port is not taken")
+	}
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.bindForward(node, f, l, held)
+
+	if f.Left.String() != addr {
+		t.Errorf("port is changed from %s to %s", addr, f.Left)
+	}
+
+	select {
+	case n := <-resolved:
+		if n != node {
+			t.Errorf("held connection is sent to %v", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("held connection is not sent to the node which is back")
+	}
+}
+
+func TestHeldPortExpires(t *testing.T) {
+	s := newTestServer()
+	s.HoldPeriod = 50 * time.Millisecond
+
+	node, _ := newBoundNode(t, s, "a", "http", nil)
+	s.releaseForwards(node)
+
+	time.Sleep(200 * time.Millisecond)
+	s.portOps.Lock()
+	defer s.portOps.Unlock()
+	if _, ok := s.ports[portKey("a", "http")]; ok {
+		t.Error("held port is not released after HoldPeriod")
+	}
+}
+
+func TestRerouteHeldPort(t *testing.T) {
+	s := newTestServer()
+	s.HoldPeriod = time.Minute
+	s.HoldPolicy = HoldPolicyReroute
+
+	held, _ := newBoundNode(t, s, "a", "http", nil)
+	other, _ := newBoundNode(t, s, "b", "http", nil)
+	newBoundNode(t, s, "c", "socks5", nil)
+
+	s.releaseForwards(held)
+
+	// connections to the held port go to another node with the same forward at once
+	n, f, _ := s.resolvePort(s.ports[portKey("a", "http")])
+	if n != other || f.Name != "http" {
+		t.Errorf("connection is rerouted to %v", n)
+	}
+}
+
+func TestHeldPortOfSameOwner(t *testing.T) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	free := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	s := newTestServer()
+	s.HoldPeriod = time.Minute
+	s.PortAllocator, _ = NewPortAllocator(free, free, "")
+
+	// the agent restarts with another id in the hold period
+	node, f := newBoundNode(t, s, "a", "http", nil)
+	if f.Left.Port != free {
+		t.Fatalf("forward is bound to %s", f.Left)
+	}
+	s.releaseForwards(node)
+
+	again, f := newForwardNode("b", "http", nil)
+	again.Name = node.Name
+	held := s.takeHeldPort(s.portOwner(again), f.Name)
+	if held == nil {
+		t.Fatal("held port is not taken by the same owner")
+	}
+
+	l, err = net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.bindForward(again, f, l, held)
+	if f.Left.Port != free {
+		t.Errorf("forward is moved to %s", f.Left)
+	}
+
+	if list := s.PortAllocator.List(); len(list) != 1 || list[0].Node != node.Name || list[0].Port != free {
+		t.Errorf("assignments %+v", list)
+	}
+}
+
+func TestAssignedPortIsKeptWhenBusy(t *testing.T) {
+	busy, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	port := busy.Addr().(*net.TCPAddr).Port
+
+	s := newTestServer()
+	s.PortAllocator, _ = NewPortAllocator(port, port, "")
+	s.PortAllocator.Assign("a", "http", nil)
+
+	// the agent port is used for this session only
+	_, f := newBoundNode(t, s, "a", "http", nil)
+	if f.Left.Port == port {
+		t.Fatal("busy port is bound")
+	}
+
+	if list := s.PortAllocator.List(); len(list) != 1 || list[0].Port != port {
+		t.Errorf("assignments %+v", list)
+	}
+}
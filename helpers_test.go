@@ -0,0 +1,197 @@
+package adslproxy
+
+import (
+	"fmt"
+	"github.com/gocloudio/crypto/ssh"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConn is the ssh connection of a test node, it records the requests
+// sent to the agent
+type fakeConn struct {
+	ssh.Conn
+
+	lock     sync.Mutex
+	requests []string
+	payloads [][]byte
+	closed   bool
+	// serve is the agent end of the channels opened to the agent, they are refused if nil
+	serve func(conn net.Conn)
+}
+
+// pipeChannel is a channel to the agent over a pipe
+type pipeChannel struct {
+	net.Conn
+}
+
+func (c *pipeChannel) CloseWrite() error     { return c.Close() }
+func (c *pipeChannel) Stderr() io.ReadWriter { return c }
+func (c *pipeChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return false, nil
+}
+
+func (c *fakeConn) OpenChannel(name string, data []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	if c.serve == nil {
+		return nil, nil, errors.New("channel is refused")
+	}
+
+	agent, server := net.Pipe()
+	go c.serve(agent)
+
+	reqs := make(chan *ssh.Request)
+	close(reqs)
+	return &pipeChannel{server}, reqs, nil
+}
+
+func (c *fakeConn) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.requests = append(c.requests, name)
+	c.payloads = append(c.payloads, payload)
+	return true, nil, nil
+}
+
+func (c *fakeConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.closed = true
+	return nil
+}
+
+// sent returns the payloads of the requests of the type
+func (c *fakeConn) sent(name string) [][]byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var payloads [][]byte
+	for i, request := range c.requests {
+		if request == name {
+			payloads = append(payloads, c.payloads[i])
+		}
+	}
+
+	return payloads
+}
+
+func newTestNode(id string) (*Node, *fakeConn) {
+	conn := &fakeConn{}
+	return &Node{
+		Id:       id,
+		Name:     id,
+		RemoteIp: "127.0.0.1",
+		conn:     &ssh.ServerConn{Conn: conn},
+	}, conn
+}
+
+func newTestServer(nodes ...*Node) *Server {
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	s := NewServer(addr, addr, "token")
+	for _, node := range nodes {
+		s.Nodes.PushBack(node)
+	}
+
+	return s
+}
+
+// newForwardNode creates a node with a forward of the name, the channels of
+// the forward are served by serve
+func newForwardNode(id, name string, serve func(conn net.Conn)) (*Node, *Forward) {
+	node, conn := newTestNode(id)
+	conn.serve = serve
+
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3128}
+	f := &Forward{Name: name, Left: addr, tunnelAddr: addr}
+	node.ForwardList = []*Forward{f}
+	return node, f
+}
+
+// newBoundNode adds a node with a forward of the name to the server, and
+// binds the forward to a port of the server
+func newBoundNode(t *testing.T, s *Server, id, name string, serve func(conn net.Conn)) (*Node, *Forward) {
+	node, f := newForwardNode(id, name, serve)
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.nodeOps.Lock()
+	s.Nodes.PushBack(node)
+	s.nodeOps.Unlock()
+
+	s.bindForward(node, f, l, nil)
+	t.Cleanup(func() { s.closePorts() })
+
+	return node, f
+}
+
+func writeTempFile(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "adslproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// fakeLine is a redialer which takes delay to redial, its exit ip served by
+// ip echo is changed by the redials in ips
+type fakeLine struct {
+	lock    sync.Mutex
+	ips     []string
+	delay   time.Duration
+	redials int
+	// previousIps are the PreviousIp of the config in the redials
+	previousIps []string
+}
+
+func (l *fakeLine) Redial(c *AdslConfig) error {
+	time.Sleep(l.delay)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.redials++
+	l.previousIps = append(l.previousIps, c.PreviousIp)
+	return nil
+}
+
+func (l *fakeLine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	fmt.Fprintln(w, l.ips[l.redials])
+}
+
+func (l *fakeLine) count() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.redials
+}
@@ -0,0 +1,151 @@
+package adslproxy
+
+import (
+	"sync"
+	"time"
+)
+
+// maxRedialsPerNode is the number of the latest redial reports kept for a node
+const maxRedialsPerNode = 50
+
+// IpReport is a complaint about an exit ip, e.g. it is blocked by a site
+type IpReport struct {
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+}
+
+// IpRecord is an exit ip which a node has been connected with
+type IpRecord struct {
+	Ip        string     `json:"ip"`
+	NodeId    string     `json:"node_id"`
+	NodeName  string     `json:"node_name"`
+	FirstSeen time.Time  `json:"first_seen"`
+	LastSeen  time.Time  `json:"last_seen"`
+	Reports   []IpReport `json:"reports"`
+	// RetiredReason is set when the node is redialed to get rid of the ip
+	RetiredReason string `json:"retired_reason,omitempty"`
+}
+
+// IpHistory keeps the latest exit ips of the nodes
+type IpHistory struct {
+	// MaxRecords is the number of records kept, the oldest ones are dropped
+	MaxRecords int
+
+	lock    sync.Mutex
+	records []*IpRecord
+	// redials are the latest redial reports by node id
+	redials map[string][]RedialRecord
+}
+
+// RedialRecord is a redial reported by the agent of a node
+type RedialRecord struct {
+	RedialReportMsg
+	// Time is when the report is received
+	Time     time.Time `json:"time"`
+	NodeName string    `json:"node_name"`
+}
+
+func NewIpHistory(maxRecords int) *IpHistory {
+	return &IpHistory{
+		MaxRecords: maxRecords,
+		redials:    make(map[string][]RedialRecord),
+	}
+}
+
+// record returns the latest record of the ip, must be called with the lock held
+func (h *IpHistory) record(ip string) *IpRecord {
+	for i := len(h.records) - 1; i >= 0; i-- {
+		if h.records[i].Ip == ip {
+			return h.records[i]
+		}
+	}
+
+	return nil
+}
+
+// Seen records that the node is connected with its current ip
+func (h *IpHistory) Seen(node *Node) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	now := time.Now()
+	if r := h.record(node.RemoteIp); r != nil && r.NodeId == node.Id && r.RetiredReason == "" {
+		r.LastSeen = now
+		return
+	}
+
+	h.records = append(h.records, &IpRecord{
+		Ip:        node.RemoteIp,
+		NodeId:    node.Id,
+		NodeName:  node.Name,
+		FirstSeen: now,
+		LastSeen:  now,
+	})
+
+	if h.MaxRecords > 0 && len(h.records) > h.MaxRecords {
+		h.records = h.records[len(h.records)-h.MaxRecords:]
+	}
+}
+
+// Report attaches a report to the ip, it is ignored if the ip is unknown
+func (h *IpHistory) Report(ip, reason string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if r := h.record(ip); r != nil {
+		r.Reports = append(r.Reports, IpReport{Time: time.Now(), Reason: reason})
+	}
+}
+
+// Retire marks the ip as abandoned for the reason, the first reason is kept
+func (h *IpHistory) Retire(ip, reason string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if r := h.record(ip); r != nil && r.RetiredReason == "" {
+		r.RetiredReason = reason
+		r.LastSeen = time.Now()
+	}
+}
+
+// AddRedial keeps the report of the node and retires the ip before the redial
+func (h *IpHistory) AddRedial(node *Node, report RedialReportMsg) {
+	h.Retire(report.PreviousIp, "redialed, "+report.Reason)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	redials := append(h.redials[node.Id], RedialRecord{
+		RedialReportMsg: report,
+		Time:            time.Now(),
+		NodeName:        node.Name,
+	})
+
+	if len(redials) > maxRedialsPerNode {
+		redials = redials[len(redials)-maxRedialsPerNode:]
+	}
+
+	h.redials[node.Id] = redials
+}
+
+// Redials returns the redial reports of the node, nil if there is none
+func (h *IpHistory) Redials(nodeId string) []RedialRecord {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return append([]RedialRecord(nil), h.redials[nodeId]...)
+}
+
+func (h *IpHistory) List() []IpRecord {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	list := make([]IpRecord, 0, len(h.records))
+	for _, r := range h.records {
+		record := *r
+		record.Reports = append([]IpReport(nil), r.Reports...)
+		list = append(list, record)
+	}
+
+	return list
+}
@@ -0,0 +1,54 @@
+package adslproxy
+
+import (
+	"testing"
+)
+
+func TestIpHistory(t *testing.T) {
+	h := NewIpHistory(2)
+	node, _ := newTestNode("a")
+
+	node.RemoteIp = "198.51.100.1"
+	h.Seen(node)
+	h.Seen(node)
+	h.Report("198.51.100.1", "blocked")
+	h.Report("203.0.113.1", "unknown ip is ignored")
+
+	h.AddRedial(node, RedialReportMsg{Reason: RedialReasonRequested, PreviousIp: "198.51.100.1", Ip: "198.51.100.2"})
+	node.RemoteIp = "198.51.100.2"
+	h.Seen(node)
+
+	records := h.List()
+	if len(records) != 2 || len(records[0].Reports) != 1 || records[0].RetiredReason == "" || records[1].RetiredReason != "" {
+		t.Fatalf("records %+v", records)
+	}
+
+	// a retired ip which the node gets again is a new record, the oldest one is dropped
+	node.RemoteIp = "198.51.100.1"
+	h.Seen(node)
+	records = h.List()
+	if len(records) != 2 || records[0].Ip != "198.51.100.2" || records[1].Ip != "198.51.100.1" || len(records[1].Reports) != 0 {
+		t.Errorf("records %+v", records)
+	}
+
+	if redials := h.Redials("a"); len(redials) != 1 || redials[0].Ip != "198.51.100.2" {
+		t.Errorf("redials %+v", redials)
+	}
+}
+
+func TestRedialsPerNode(t *testing.T) {
+	h := NewIpHistory(10)
+	node, _ := newTestNode("a")
+	for i := 0; i < maxRedialsPerNode+5; i++ {
+		h.AddRedial(node, RedialReportMsg{Attempts: make([]RedialAttempt, i)})
+	}
+
+	redials := h.Redials("a")
+	if len(redials) != maxRedialsPerNode || len(redials[0].Attempts) != 5 {
+		t.Errorf("%d redials are kept", len(redials))
+	}
+
+	if h.Redials("b") != nil {
+		t.Error("redials of unknown node")
+	}
+}
@@ -0,0 +1,367 @@
+package adslproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// httpResponseLimit is the max bytes of a router response which is matched
+const httpResponseLimit = 1 << 20
+
+// HttpStep is a request to the router. Path, Body and Headers are templates
+// of httpStepVars, with a json function to quote strings in json bodies.
+type HttpStep struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Body    string            `json:"body"`
+	Headers map[string]string `json:"headers"`
+	// Match is a regexp which the response body must match, the first group
+	// of the login step is kept as the token of the later steps
+	Match string `json:"match"`
+
+	path    *template.Template
+	body    *template.Template
+	headers map[string]*template.Template
+	match   *regexp.Regexp
+}
+
+type httpStepVars struct {
+	Username  string
+	Password  string
+	Interface string
+	Token     string
+}
+
+// HttpRedialer redials the line of a router through its web or json-rpc api.
+// It logs in, disconnects the wan and waits for it to be down, connects it
+// and polls the status until it is up. Cookies are kept between the steps.
+type HttpRedialer struct {
+	// Profile fills the steps of a known router, e.g. openwrt
+	Profile string `json:"profile"`
+	// Url is the base url of the router api, e.g. http://192.168.1.1
+	Url       string `json:"url"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	BasicAuth bool   `json:"basic_auth"`
+	// Interface is the wan of the router, InterfaceName of AdslConfig is used if empty
+	Interface string `json:"interface"`
+
+	Login      *HttpStep `json:"login"`
+	Disconnect *HttpStep `json:"disconnect"`
+	// Down is polled after Disconnect until it matches, so that Status is not
+	// matched by the session before the redial
+	Down    *HttpStep `json:"down"`
+	Connect *HttpStep `json:"connect"`
+	// Status is polled every PollInterval until it matches, Down and Status
+	// are polled in Timeout seconds
+	Status       *HttpStep `json:"status"`
+	Timeout      int       `json:"timeout"`
+	PollInterval int       `json:"poll_interval"`
+}
+
+// ubusOk matches the result of a successful ubus call, a json-rpc response
+// with the error status of ubus in the result is returned with http 200
+const ubusOk = `"result"\s*:\s*\[\s*0\b`
+
+// ubusCall is the json-rpc body of a ubus call of OpenWrt, token is the session
+func ubusCall(object, method string) string {
+	return `{"jsonrpc":"2.0","id":1,"method":"call","params":[{{json .Token}},"` + object + `","` + method + `",{}]}`
+}
+
+var httpRedialerProfiles = map[string]HttpRedialer{
+	"openwrt": {
+		Username:  "root",
+		Interface: "wan",
+		Login: &HttpStep{
+			Method: "POST",
+			Path:   "/ubus",
+			Body: `{"jsonrpc":"2.0","id":1,"method":"call","params":["00000000000000000000000000000000",` +
+				`"session","login",{"username":{{json .Username}},"password":{{json .Password}}}]}`,
+			Match: `"ubus_rpc_session"\s*:\s*"([0-9a-f]+)"`,
+		},
+		Disconnect: &HttpStep{
+			Method: "POST",
+			Path:   "/ubus",
+			Body:   ubusCall("network.interface.{{.Interface}}", "down"),
+			Match:  ubusOk,
+		},
+		Down: &HttpStep{
+			Method: "POST",
+			Path:   "/ubus",
+			Body:   ubusCall("network.interface.{{.Interface}}", "status"),
+			Match:  `"up"\s*:\s*false`,
+		},
+		Connect: &HttpStep{
+			Method: "POST",
+			Path:   "/ubus",
+			Body:   ubusCall("network.interface.{{.Interface}}", "up"),
+			Match:  ubusOk,
+		},
+		Status: &HttpStep{
+			Method: "POST",
+			Path:   "/ubus",
+			Body:   ubusCall("network.interface.{{.Interface}}", "status"),
+			Match:  `"up"\s*:\s*true`,
+		},
+	},
+}
+
+var httpStepFuncs = template.FuncMap{
+	"json": func(s string) string {
+		data, _ := json.Marshal(s)
+		return string(data)
+	},
+}
+
+func (step *HttpStep) clone() *HttpStep {
+	if step == nil {
+		return nil
+	}
+
+	c := *step
+	c.Headers = make(map[string]string, len(step.Headers))
+	for name, value := range step.Headers {
+		c.Headers[name] = value
+	}
+
+	return &c
+}
+
+func (step *HttpStep) compile() error {
+	if step.Method == "" {
+		step.Method = "GET"
+	}
+
+	var err error
+	if step.path, err = template.New("path").Funcs(httpStepFuncs).Parse(step.Path); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if step.body, err = template.New("body").Funcs(httpStepFuncs).Parse(step.Body); err != nil {
+		return errors.WithStack(err)
+	}
+
+	step.headers = make(map[string]*template.Template)
+	for name, value := range step.Headers {
+		if step.headers[name], err = template.New(name).Funcs(httpStepFuncs).Parse(value); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if step.Match != "" {
+		if step.match, err = regexp.Compile(step.Match); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+func execute(t *template.Template, vars *httpStepVars) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, vars); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return buf.String(), nil
+}
+
+// do sends the step and returns the first group of Match, or the whole match if there is no group
+func (hr *HttpRedialer) do(client *http.Client, step *HttpStep, vars *httpStepVars) (string, error) {
+	path, err := execute(step.path, vars)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := execute(step.body, vars)
+	if err != nil {
+		return "", err
+	}
+
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+
+	req, err := http.NewRequest(step.Method, strings.TrimSuffix(hr.Url, "/")+path, reader)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	for name, t := range step.headers {
+		value, err := execute(t, vars)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set(name, value)
+	}
+
+	if hr.BasicAuth {
+		req.SetBasicAuth(hr.Username, hr.Password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, httpResponseLimit))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	if resp.StatusCode >= 400 {
+		return "", errors.Errorf("%s %s returns %d", step.Method, path, resp.StatusCode)
+	}
+
+	if step.match == nil {
+		return "", nil
+	}
+
+	matches := step.match.FindSubmatch(data)
+	if matches == nil {
+		return "", errors.Errorf("response of %s %s does not match %s", step.Method, path, step.Match)
+	}
+
+	if len(matches) > 1 {
+		return string(matches[1]), nil
+	}
+
+	return string(matches[0]), nil
+}
+
+func (hr *HttpRedialer) Redial(c *AdslConfig) error {
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar:     jar,
+		Timeout: time.Duration(hr.Timeout) * time.Second,
+	}
+
+	vars := &httpStepVars{
+		Username:  hr.Username,
+		Password:  hr.Password,
+		Interface: hr.Interface,
+	}
+
+	if vars.Interface == "" {
+		vars.Interface = c.InterfaceName
+	}
+
+	if hr.Login != nil {
+		token, err := hr.do(client, hr.Login, vars)
+		if err != nil {
+			return errors.Wrap(err, "failed to login router")
+		}
+		vars.Token = token
+	}
+
+	if _, err := hr.do(client, hr.Disconnect, vars); err != nil {
+		return errors.Wrap(err, "failed to disconnect wan")
+	}
+
+	deadline := time.Now().Add(time.Duration(hr.Timeout) * time.Second)
+	if err := hr.poll(client, hr.Down, vars, deadline); err != nil {
+		return errors.Wrap(err, "wan is not down")
+	}
+
+	if _, err := hr.do(client, hr.Connect, vars); err != nil {
+		return errors.Wrap(err, "failed to connect wan")
+	}
+
+	if err := hr.poll(client, hr.Status, vars, deadline); err != nil {
+		return errors.Wrap(err, "wan is not up")
+	}
+
+	return nil
+}
+
+// poll sends the step every PollInterval until it succeeds or the deadline is passed
+func (hr *HttpRedialer) poll(client *http.Client, step *HttpStep, vars *httpStepVars, deadline time.Time) error {
+	if step == nil {
+		return nil
+	}
+
+	for {
+		_, err := hr.do(client, step, vars)
+		if err == nil {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return err
+		}
+
+		glog.V(2).Infof("waiting for wan of router %s", err)
+		time.Sleep(time.Duration(hr.PollInterval) * time.Second)
+	}
+}
+
+// NewHttpRedialer creates a router redialer from its config section
+func NewHttpRedialer(section json.RawMessage) (*HttpRedialer, error) {
+	var profile struct {
+		Profile string `json:"profile"`
+	}
+
+	if err := parseSection(section, &profile); err != nil {
+		return nil, err
+	}
+
+	r := &HttpRedialer{}
+	if profile.Profile != "" {
+		p, ok := httpRedialerProfiles[profile.Profile]
+		if !ok {
+			return nil, errors.Errorf("unknown router profile %s", profile.Profile)
+		}
+		*r = p
+		// the steps of the profile are shared, the section is decoded into copies
+		r.Login, r.Disconnect, r.Down = p.Login.clone(), p.Disconnect.clone(), p.Down.clone()
+		r.Connect, r.Status = p.Connect.clone(), p.Status.clone()
+	}
+
+	r.Timeout = 60
+	r.PollInterval = 2
+	if err := parseSection(section, r); err != nil {
+		return nil, err
+	}
+
+	if r.Url == "" {
+		return nil, errors.New("url of router is required")
+	}
+
+	if r.Disconnect == nil || r.Connect == nil {
+		return nil, errors.New("disconnect and connect steps are required")
+	}
+
+	if r.Timeout <= 0 || r.PollInterval <= 0 {
+		return nil, errors.Errorf("illegal timeout %d or poll interval %d", r.Timeout, r.PollInterval)
+	}
+
+	for _, step := range []*HttpStep{r.Login, r.Disconnect, r.Down, r.Connect, r.Status} {
+		if step == nil {
+			continue
+		}
+
+		if err := step.compile(); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+func init() {
+	RegisterRedialer("http", func(section json.RawMessage) (Redialer, error) {
+		return NewHttpRedialer(section)
+	})
+}
@@ -0,0 +1,133 @@
+package adslproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testUbusSession = "0123456789abcdef0123456789abcdef"
+
+// fakeUbus is an OpenWrt router whose wan is still reported up by the first
+// status after it is brought down
+type fakeUbus struct {
+	lock sync.Mutex
+	// calls are the "object method" of the ubus calls in order
+	calls []string
+	// failing is the method returning an error status of ubus
+	failing string
+	up      bool
+	stale   bool
+}
+
+func (u *fakeUbus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Params []json.RawMessage `json:"params"`
+	}
+
+	if r.URL.Path != "/ubus" || json.NewDecoder(r.Body).Decode(&req) != nil || len(req.Params) != 4 {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	var session, object, method string
+	json.Unmarshal(req.Params[0], &session)
+	json.Unmarshal(req.Params[1], &object)
+	json.Unmarshal(req.Params[2], &method)
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.calls = append(u.calls, object+" "+method)
+	if method == u.failing || (object != "session" && session != testUbusSession) {
+		fmt.Fprint(w, `{"jsonrpc":"2.0","id":1,"result":[6]}`)
+		return
+	}
+
+	switch method {
+	case "login":
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":1,"result":[0,{"ubus_rpc_session":"%s"}]}`, testUbusSession)
+		return
+	case "down":
+		u.up = false
+		u.stale = true
+	case "up":
+		u.up = true
+	case "status":
+		up := u.up || u.stale
+		u.stale = false
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":1,"result":[0,{"up":%v}]}`, up)
+		return
+	}
+
+	fmt.Fprint(w, `{"jsonrpc":"2.0","id":1,"result":[0]}`)
+}
+
+func newOpenwrtRedialer(t *testing.T, url string) *HttpRedialer {
+	r, err := NewHttpRedialer(json.RawMessage(`{"profile": "openwrt", "url": "` + url + `", "password": "secret", "poll_interval": 1, "timeout": 5}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+func TestOpenwrtRedial(t *testing.T) {
+	ubus := &fakeUbus{up: true}
+	server := httptest.NewServer(ubus)
+	defer server.Close()
+
+	if err := newOpenwrtRedialer(t, server.URL).Redial(&AdslConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the stale status after the disconnect is not taken as down
+	expected := "session login,network.interface.wan down,network.interface.wan status," +
+		"network.interface.wan status,network.interface.wan up,network.interface.wan status"
+	if calls := strings.Join(ubus.calls, ","); calls != expected {
+		t.Errorf("calls %s", calls)
+	}
+}
+
+func TestOpenwrtRedialFailedStep(t *testing.T) {
+	for _, method := range []string{"login", "down", "up"} {
+		ubus := &fakeUbus{up: true, failing: method}
+		server := httptest.NewServer(ubus)
+
+		err := newOpenwrtRedialer(t, server.URL).Redial(&AdslConfig{})
+		server.Close()
+
+		if err == nil {
+			t.Errorf("failure of %s is not reported", method)
+			continue
+		}
+
+		if ubus.calls[len(ubus.calls)-1] != "network.interface.wan "+method && method != "login" {
+			t.Errorf("redial goes on after %s fails %v", method, ubus.calls)
+		}
+	}
+}
+
+func TestHttpRedialerStatusTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"up": false}`)
+	}))
+	defer server.Close()
+
+	r, err := NewHttpRedialer(json.RawMessage(`{
+		"url": "` + server.URL + `", "timeout": 1, "poll_interval": 1,
+		"disconnect": {"path": "/down"}, "connect": {"path": "/up"},
+		"status": {"path": "/status", "match": "\"up\"\\s*:\\s*true"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Redial(&AdslConfig{}); err == nil || !strings.Contains(err.Error(), "not up") {
+		t.Errorf("wan which never comes up is redialed %v", err)
+	}
+}
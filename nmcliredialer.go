@@ -0,0 +1,148 @@
+package adslproxy
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CommandRunner runs a command and returns its combined output, a fake one
+// can be given to redialers in tests
+type CommandRunner func(timeout time.Duration, name string, arg ...string) ([]byte, error)
+
+var pppIface = regexp.MustCompile(`^ppp\d+$`)
+
+// NmcliRedialer brings a NetworkManager PPPoE connection down and up, and
+// waits until its ppp device is activated with a default route
+type NmcliRedialer struct {
+	// Connection is the id of the NetworkManager connection
+	Connection string `json:"connection"`
+	Nmcli      string `json:"nmcli"`
+	Ip         string `json:"ip"`
+	// Timeout is in seconds
+	Timeout int `json:"timeout"`
+
+	Run CommandRunner `json:"-"`
+}
+
+// NewNmcliRedialer creates the redialer from its config section, the commands
+// are run by run, or looked up and run on the host if it is nil
+func NewNmcliRedialer(section json.RawMessage, run CommandRunner) (*NmcliRedialer, error) {
+	r := &NmcliRedialer{
+		Nmcli:   "nmcli",
+		Ip:      "ip",
+		Timeout: 60,
+		Run:     run,
+	}
+
+	if err := parseSection(section, r); err != nil {
+		return nil, err
+	}
+
+	if r.Connection == "" {
+		return nil, errors.New("connection is required")
+	}
+
+	if r.Timeout <= 0 {
+		return nil, errors.Errorf("illegal timeout %d", r.Timeout)
+	}
+
+	if r.Run == nil {
+		if err := lookPaths(r.Nmcli, r.Ip); err != nil {
+			return nil, err
+		}
+
+		r.Run = runCommand
+	}
+
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// validate checks that the connection exists and is a PPPoE connection
+func (nr *NmcliRedialer) validate() error {
+	output, err := nr.Run(nr.timeout(), nr.Nmcli, "-g", "connection.type", "connection", "show", "id", nr.Connection)
+	if err != nil {
+		return errors.Wrapf(err, "connection %s is not found %s", nr.Connection, output)
+	}
+
+	if t := strings.TrimSpace(string(output)); t != "pppoe" {
+		return errors.Errorf("connection %s is %s rather than pppoe", nr.Connection, t)
+	}
+
+	return nil
+}
+
+func (nr *NmcliRedialer) timeout() time.Duration {
+	return time.Duration(nr.Timeout) * time.Second
+}
+
+func (nr *NmcliRedialer) Redial(_ *AdslConfig) error {
+	if output, err := nr.Run(nr.timeout(), nr.Nmcli, "connection", "down", "id", nr.Connection); err != nil {
+		// the connection may be down already
+		glog.Infof("failed to bring down connection %s %s %s", nr.Connection, err, output)
+	}
+
+	output, err := nr.Run(nr.timeout(), nr.Nmcli, "--wait", strconv.Itoa(nr.Timeout), "connection", "up", "id", nr.Connection)
+	if err != nil {
+		return errors.Wrapf(err, "failed to bring up connection %s %s", nr.Connection, output)
+	}
+
+	deadline := time.Now().Add(nr.timeout())
+	for {
+		err := nr.checkActivated()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+
+		glog.V(2).Infof("waiting for connection %s %s", nr.Connection, err)
+		time.Sleep(time.Second)
+	}
+}
+
+// checkActivated checks that the connection is activated on a ppp device which has the default route
+func (nr *NmcliRedialer) checkActivated() error {
+	output, err := nr.Run(nr.timeout(), nr.Nmcli, "-g", "GENERAL.STATE,GENERAL.IP-IFACE", "connection", "show", "id", nr.Connection)
+	if err != nil {
+		return errors.Wrapf(err, "failed to show connection %s", output)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if len(lines) < 2 || strings.TrimSpace(lines[0]) != "activated" {
+		return errors.Errorf("connection %s is not activated", nr.Connection)
+	}
+
+	iface := strings.TrimSpace(lines[1])
+	if !pppIface.MatchString(iface) {
+		return errors.Errorf("connection %s is not on a ppp device but %s", nr.Connection, iface)
+	}
+
+	output, err = nr.Run(nr.timeout(), nr.Ip, "route", "show", "default")
+	if err != nil {
+		return errors.Wrapf(err, "failed to show routes %s", output)
+	}
+
+	for _, route := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(route)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "dev" && fields[i+1] == iface {
+				return nil
+			}
+		}
+	}
+
+	return errors.Errorf("no default route on %s", iface)
+}
+
+func init() {
+	RegisterRedialer("nmcli", func(section json.RawMessage) (Redialer, error) {
+		return NewNmcliRedialer(section, nil)
+	})
+}
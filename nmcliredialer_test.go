@@ -0,0 +1,113 @@
+package adslproxy
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNmcli answers the commands of NmcliRedialer by their arguments
+type fakeNmcli struct {
+	commands []string
+	outputs  map[string]string
+	failing  map[string]bool
+}
+
+func (f *fakeNmcli) run(_ time.Duration, name string, arg ...string) ([]byte, error) {
+	command := strings.Join(append([]string{name}, arg...), " ")
+	f.commands = append(f.commands, command)
+
+	for prefix := range f.failing {
+		if strings.HasPrefix(command, prefix) {
+			return []byte("error"), errors.New("exit status 10")
+		}
+	}
+
+	for prefix, output := range f.outputs {
+		if strings.HasPrefix(command, prefix) {
+			return []byte(output), nil
+		}
+	}
+
+	return nil, nil
+}
+
+func newFakeNmcli() *fakeNmcli {
+	return &fakeNmcli{
+		outputs: map[string]string{
+			"nmcli -g connection.type":                "pppoe\n",
+			"nmcli -g GENERAL.STATE,GENERAL.IP-IFACE": "activated\nppp0\n",
+			"ip route show default":                   "default dev ppp0 scope link\n",
+		},
+		failing: map[string]bool{},
+	}
+}
+
+func TestNmcliRedialer(t *testing.T) {
+	nmcli := newFakeNmcli()
+	r, err := NewNmcliRedialer(json.RawMessage(`{"connection": "dsl"}`), nmcli.run)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the connection may be down already
+	nmcli.failing["nmcli connection down"] = true
+	if err := r.Redial(&AdslConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"nmcli -g connection.type connection show id dsl",
+		"nmcli connection down id dsl",
+		"nmcli --wait 60 connection up id dsl",
+		"nmcli -g GENERAL.STATE,GENERAL.IP-IFACE connection show id dsl",
+		"ip route show default",
+	}
+	if strings.Join(nmcli.commands, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("commands %q", nmcli.commands)
+	}
+
+	nmcli.failing["nmcli --wait"] = true
+	if err := r.Redial(&AdslConfig{}); err == nil {
+		t.Error("failure to bring up connection is not reported")
+	}
+}
+
+func TestNmcliRedialerNotPppoe(t *testing.T) {
+	nmcli := newFakeNmcli()
+	nmcli.outputs["nmcli -g connection.type"] = "802-3-ethernet\n"
+	if _, err := NewNmcliRedialer(json.RawMessage(`{"connection": "dsl"}`), nmcli.run); err == nil {
+		t.Error("connection which is not pppoe is accepted")
+	}
+
+	nmcli.failing["nmcli -g connection.type"] = true
+	if _, err := NewNmcliRedialer(json.RawMessage(`{"connection": "dsl"}`), nmcli.run); err == nil {
+		t.Error("missing connection is accepted")
+	}
+}
+
+func TestNmcliCheckActivated(t *testing.T) {
+	cases := []struct {
+		state  string
+		routes string
+		ok     bool
+	}{
+		{"activated\nppp0\n", "default dev ppp0 scope link\n", true},
+		{"activating\n\n", "", false},
+		{"activated\neth0\n", "default via 192.168.1.1 dev eth0\n", false},
+		{"activated\nppp0\n", "default via 192.168.1.1 dev eth0\n", false},
+	}
+
+	for _, c := range cases {
+		nmcli := newFakeNmcli()
+		nmcli.outputs["nmcli -g GENERAL.STATE,GENERAL.IP-IFACE"] = c.state
+		nmcli.outputs["ip route show default"] = c.routes
+
+		r := &NmcliRedialer{Connection: "dsl", Nmcli: "nmcli", Ip: "ip", Timeout: 1, Run: nmcli.run}
+		if err := r.checkActivated(); (err == nil) != c.ok {
+			t.Errorf("%q %q: %v", c.state, c.routes, err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package adslproxy
+
+import (
+	"github.com/gocloudio/crypto/ssh"
+	"github.com/pkg/errors"
+	"net"
+	"strings"
+)
+
+// BindPolicy restricts the forwards that agents are allowed to register on
+// the server. Zero values mean no restriction.
+type BindPolicy struct {
+	// AllowedAddrs are the IPs which forwards may listen on
+	AllowedAddrs []net.IP
+	// MinPort and MaxPort limit the ports which forwards may request, the
+	// ports chosen by the server are not limited
+	MinPort int
+	MaxPort int
+	// MaxForwards is the max number of forwards of a node
+	MaxForwards int
+	// AllowedNames are the names of forwards which may be registered
+	AllowedNames []string
+	// reservedPorts are used by the server itself
+	reservedPorts []int
+}
+
+// checkRequest checks a tunnel request before anything is bound for it
+func (p *BindPolicy) checkRequest(node *Node, msg ssh.NamedTunnelForwardMsg) error {
+	if p == nil {
+		return nil
+	}
+
+	if p.MaxForwards > 0 && len(node.ForwardList) >= p.MaxForwards {
+		return errors.Errorf("node has reached the max number of forwards %d", p.MaxForwards)
+	}
+
+	if err := p.checkAddr(msg.Addr, int(msg.Port)); err != nil {
+		return err
+	}
+
+	if len(p.AllowedNames) == 0 {
+		return nil
+	}
+
+	for _, name := range p.AllowedNames {
+		if name == msg.Name {
+			return nil
+		}
+	}
+
+	return errors.Errorf("forward name %s is not allowed", msg.Name)
+}
+
+// checkAddr checks the addr and port requested by a forward, port 0 leaves
+// the port to the server and is not checked
+func (p *BindPolicy) checkAddr(host string, port int) error {
+	if port != 0 {
+		for _, reserved := range p.reservedPorts {
+			if port == reserved {
+				return errors.Errorf("port %d is used by the server", port)
+			}
+		}
+
+		if p.MinPort > 0 && port < p.MinPort || p.MaxPort > 0 && port > p.MaxPort {
+			return errors.Errorf("port %d is out of range %d-%d", port, p.MinPort, p.MaxPort)
+		}
+	}
+
+	if len(p.AllowedAddrs) == 0 {
+		return nil
+	}
+
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	for _, allowed := range p.AllowedAddrs {
+		if allowed.Equal(ip) {
+			return nil
+		}
+	}
+
+	return errors.Errorf("address %s is not allowed", host)
+}
@@ -0,0 +1,51 @@
+package adslproxy
+
+import (
+	"github.com/gocloudio/crypto/ssh"
+	"net"
+	"testing"
+)
+
+func TestBindPolicyCheckRequest(t *testing.T) {
+	policy := &BindPolicy{
+		AllowedAddrs:  []net.IP{net.ParseIP("::"), net.ParseIP("10.0.0.1")},
+		MinPort:       20000,
+		MaxPort:       30000,
+		MaxForwards:   2,
+		AllowedNames:  []string{"http", "socks5"},
+		reservedPorts: []int{22222},
+	}
+
+	node := &Node{}
+	cases := []struct {
+		msg     ssh.NamedTunnelForwardMsg
+		allowed bool
+	}{
+		{ssh.NamedTunnelForwardMsg{Addr: "::", Port: 0, Name: "http"}, true},
+		{ssh.NamedTunnelForwardMsg{Addr: "[::]", Port: 25000, Name: "socks5"}, true},
+		{ssh.NamedTunnelForwardMsg{Addr: "10.0.0.1", Port: 20000, Name: "http"}, true},
+		{ssh.NamedTunnelForwardMsg{Addr: "10.0.0.2", Port: 0, Name: "http"}, false},
+		{ssh.NamedTunnelForwardMsg{Addr: "::", Port: 80, Name: "http"}, false},
+		{ssh.NamedTunnelForwardMsg{Addr: "::", Port: 30001, Name: "http"}, false},
+		{ssh.NamedTunnelForwardMsg{Addr: "::", Port: 22222, Name: "http"}, false},
+		{ssh.NamedTunnelForwardMsg{Addr: "::", Port: 0, Name: "ssh"}, false},
+	}
+
+	for _, c := range cases {
+		if err := policy.checkRequest(node, c.msg); (err == nil) != c.allowed {
+			t.Errorf("request %+v allowed %v, error %v", c.msg, c.allowed, err)
+		}
+	}
+
+	node.ForwardList = []*Forward{{Name: "http"}, {Name: "socks5"}}
+	if err := policy.checkRequest(node, ssh.NamedTunnelForwardMsg{Addr: "::", Name: "http"}); err == nil {
+		t.Errorf("forwards over MaxForwards are allowed")
+	}
+}
+
+func TestNilBindPolicy(t *testing.T) {
+	var policy *BindPolicy
+	if err := policy.checkRequest(&Node{}, ssh.NamedTunnelForwardMsg{Addr: "1.2.3.4", Port: 1}); err != nil {
+		t.Errorf("nil policy rejects %v", err)
+	}
+}
@@ -0,0 +1,266 @@
+package adslproxy
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// PortKeyName keys port assignments by the name of the node
+	PortKeyName = "name"
+	// PortKeyId keys port assignments by the id of the node
+	PortKeyId = "id"
+)
+
+// PortAssignment maps a forward of a node to a server port
+type PortAssignment struct {
+	Node    string `json:"node"`
+	Forward string `json:"forward"`
+	Port    int    `json:"port"`
+	// Pinned assignments are set through the api and never reassigned
+	Pinned bool `json:"pinned"`
+}
+
+// PortAllocator assigns server ports to forwards from a range, and remembers
+// the assignments across reconnects. If a path is given, the assignments are
+// saved to it so that they survive restarts of the server.
+type PortAllocator struct {
+	MinPort int
+	MaxPort int
+
+	path        string
+	assignments map[string]*PortAssignment
+	lock        sync.Mutex
+}
+
+// ParsePortRange parses a range in the form of "20000-20999"
+func ParsePortRange(r string) (min, max int, err error) {
+	parts := strings.Split(r, "-")
+	if len(parts) != 2 {
+		return 0, 0, errors.Errorf("illegal port range %s", r)
+	}
+
+	if min, err = strconv.Atoi(strings.TrimSpace(parts[0])); err != nil {
+		return 0, 0, errors.Wrapf(err, "illegal port range %s", r)
+	}
+
+	if max, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil {
+		return 0, 0, errors.Wrapf(err, "illegal port range %s", r)
+	}
+
+	if min <= 0 || max > 65535 || min > max {
+		return 0, 0, errors.Errorf("illegal port range %s", r)
+	}
+
+	return min, max, nil
+}
+
+func NewPortAllocator(minPort, maxPort int, path string) (*PortAllocator, error) {
+	a := &PortAllocator{
+		MinPort:     minPort,
+		MaxPort:     maxPort,
+		path:        path,
+		assignments: make(map[string]*PortAssignment),
+	}
+
+	if path == "" {
+		return a, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return a, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var assignments []*PortAssignment
+	if err := json.Unmarshal(data, &assignments); err != nil {
+		return nil, errors.Wrapf(err, "failed to load port assignments from %s", path)
+	}
+
+	for _, pa := range assignments {
+		a.assignments[portKey(pa.Node, pa.Forward)] = pa
+	}
+
+	glog.Infof("%d port assignments are loaded from %s", len(assignments), path)
+	return a, nil
+}
+
+// portOwner returns the assignment which holds the port, must be called with the lock held
+func (a *PortAllocator) portOwner(port int) *PortAssignment {
+	for _, pa := range a.assignments {
+		if pa.Port == port {
+			return pa
+		}
+	}
+
+	return nil
+}
+
+// Assign returns the port of the forward, a free port in the range is
+// assigned if the forward has none yet, which is told by fresh. Ports in busy
+// are not assigned, but an existing assignment is returned even if it is busy.
+func (a *PortAllocator) Assign(node, forward string, busy map[int]bool) (port int, fresh bool, err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	key := portKey(node, forward)
+	if pa, ok := a.assignments[key]; ok {
+		return pa.Port, false, nil
+	}
+
+	for port := a.MinPort; port <= a.MaxPort; port++ {
+		if busy[port] || a.portOwner(port) != nil {
+			continue
+		}
+
+		a.assignments[key] = &PortAssignment{
+			Node:    node,
+			Forward: forward,
+			Port:    port,
+		}
+
+		return port, true, a.save()
+	}
+
+	return 0, false, errors.Errorf("no free port in range %d-%d", a.MinPort, a.MaxPort)
+}
+
+// Pin assigns the port to the forward permanently
+func (a *PortAllocator) Pin(node, forward string, port int) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if port <= 0 || port > 65535 {
+		return errors.Errorf("illegal port %d", port)
+	}
+
+	key := portKey(node, forward)
+	if owner := a.portOwner(port); owner != nil && portKey(owner.Node, owner.Forward) != key {
+		if owner.Pinned {
+			return errors.Errorf("port %d is pinned to %s/%s", port, owner.Node, owner.Forward)
+		}
+
+		delete(a.assignments, portKey(owner.Node, owner.Forward))
+	}
+
+	a.assignments[key] = &PortAssignment{
+		Node:    node,
+		Forward: forward,
+		Port:    port,
+		Pinned:  true,
+	}
+
+	return a.save()
+}
+
+// Remove drops the assignment of the forward
+func (a *PortAllocator) Remove(node, forward string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	delete(a.assignments, portKey(node, forward))
+	return a.save()
+}
+
+func (a *PortAllocator) List() []PortAssignment {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	list := make([]PortAssignment, 0, len(a.assignments))
+	for _, pa := range a.assignments {
+		list = append(list, *pa)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Port < list[j].Port
+	})
+
+	return list
+}
+
+// save writes the assignments to the file, must be called with the lock held
+func (a *PortAllocator) save() error {
+	if a.path == "" {
+		return nil
+	}
+
+	list := make([]*PortAssignment, 0, len(a.assignments))
+	for _, pa := range a.assignments {
+		list = append(list, pa)
+	}
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	tmp := a.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(os.Rename(tmp, a.path))
+}
+
+// portOwner returns the name which the ports of the node are held and assigned by
+func (s *Server) portOwner(node *Node) string {
+	if s.PortKey == PortKeyId {
+		return node.Id
+	}
+
+	return node.Name
+}
+
+// listenAssignedPort listens on the port assigned to the forward of the owner.
+// The listener of the tunnel request is returned as is if it already listens
+// on it. A port which fails to bind is tried again a few times if it has been
+// assigned before, since it is likely not released yet, and the assignment is
+// kept even if it still fails.
+func (s *Server) listenAssignedPort(owner string, f *Forward, listener *net.TCPListener) (*net.TCPListener, error) {
+	addr := listener.Addr().(*net.TCPAddr)
+	busy := make(map[int]bool)
+
+	for {
+		port, fresh, err := s.PortAllocator.Assign(owner, f.Name, busy)
+		if err != nil {
+			return nil, err
+		}
+
+		if port == addr.Port {
+			return listener, nil
+		}
+
+		for i := 0; ; i++ {
+			l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: addr.IP, Port: port, Zone: addr.Zone})
+			if err == nil {
+				return l, nil
+			}
+
+			glog.Errorf("failed to listen on assigned port %d of %s %s", port, f, err)
+			if fresh {
+				break
+			}
+
+			if i >= PortBindRetries {
+				return nil, err
+			}
+
+			time.Sleep(PortBindRetryInterval)
+		}
+
+		// the port is taken by another process, the next free one is assigned
+		s.PortAllocator.Remove(owner, f.Name)
+		busy[port] = true
+	}
+}
@@ -0,0 +1,93 @@
+package adslproxy
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestParsePortRange(t *testing.T) {
+	min, max, err := ParsePortRange("20000 - 20999")
+	if err != nil || min != 20000 || max != 20999 {
+		t.Errorf("range %d-%d %v", min, max, err)
+	}
+
+	for _, r := range []string{"20000", "0-10", "10-5", "1-65536", "a-b"} {
+		if _, _, err := ParsePortRange(r); err == nil {
+			t.Errorf("%s is parsed", r)
+		}
+	}
+}
+
+func TestPortAllocator(t *testing.T) {
+	path := filepath.Join(filepath.Dir(writeTempFile(t, "empty", "")), "ports.json")
+	a, err := NewPortAllocator(20000, 20002, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, _, _ := a.Assign("node-1", "http", nil)
+	second, fresh, _ := a.Assign("node-2", "http", nil)
+	if first != 20000 || second != 20001 || !fresh {
+		t.Errorf("ports %d %d", first, second)
+	}
+
+	// the assignment is stable across reconnects and restarts
+	a, err = NewPortAllocator(20000, 20002, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if port, fresh, _ := a.Assign("node-1", "http", nil); port != first || fresh {
+		t.Errorf("port of node-1 is changed to %d after restart", port)
+	}
+
+	// an assigned port is kept even if it is busy for now
+	if port, _, _ := a.Assign("node-1", "http", map[int]bool{first: true}); port != first {
+		t.Errorf("busy port is reassigned to %d", port)
+	}
+
+	if port, _, _ := a.Assign("node-3", "http", map[int]bool{20002: true}); port != 0 {
+		t.Errorf("busy port %d is assigned", port)
+	}
+
+	if _, _, err := a.Assign("node-4", "http", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := a.Assign("node-3", "http", nil); err == nil {
+		t.Error("port is assigned out of the range")
+	}
+
+	if err := a.Pin("node-4", "http", second); err != nil {
+		t.Fatal(err)
+	}
+
+	if port, _, _ := a.Assign("node-4", "http", map[int]bool{second: true}); port != second {
+		t.Errorf("pinned port is reassigned to %d", port)
+	}
+
+	if err := a.Pin("node-2", "http", second); err == nil {
+		t.Error("a pinned port is taken by another forward")
+	}
+
+	a.Remove("node-4", "http")
+	for _, pa := range a.List() {
+		if pa.Node == "node-4" || pa.Node == "node-2" {
+			t.Errorf("assignment %+v is not removed", pa)
+		}
+	}
+}
+
+func TestPortOwner(t *testing.T) {
+	node := &Node{Id: "id-1", Name: "name-1"}
+
+	s := newTestServer()
+	if s.portOwner(node) != "name-1" {
+		t.Error("ports are not keyed by node name by default")
+	}
+
+	s.PortKey = PortKeyId
+	if s.portOwner(node) != "id-1" {
+		t.Error("ports are not keyed by node id")
+	}
+}
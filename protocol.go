@@ -14,8 +14,101 @@ const WriteTimeout = 6 * time.Second
 
 const ClientConnectTimeout = 5 * time.Second
 
+const ProxyHandshakeTimeout = 10 * time.Second
+
+const UsageSaveInterval = time.Minute
+
+// Reconnect is sent by server with a ReconnectMsg to ask agent to redial
 const Reconnect = "adslproxy-reconnect"
 
+type ReconnectMsg struct {
+	Reason string `json:"reason"`
+	// Delay is the milliseconds to wait before the redial
+	Delay int64 `json:"delay"`
+	// Force redials even if the line is redialed within MinRedialInterval of agent
+	Force bool `json:"force"`
+}
+
+// NodeLabels is sent by agent with a json array of its labels
+const NodeLabels = "adslproxy-labels"
+
+// ThrottleLimits is sent by server with a json object of the rate limits by scope
+const ThrottleLimits = "adslproxy-throttle"
+
+const DefaultDrainTimeout = 30 * time.Second
+
+const DrainCheckInterval = 500 * time.Millisecond
+
+const ConnQueueCheckInterval = 50 * time.Millisecond
+
+const DefaultReportWindow = 10 * time.Minute
+
+const DefaultIpHistorySize = 1000
+
+// DialError is sent by agent with a DialErrorMsg when it fails to connect to the service of a forward
+const DialError = "adslproxy-dial-error"
+
+type DialErrorMsg struct {
+	Forward string `json:"forward"`
+	Error   string `json:"error"`
+}
+
+// RedialReport is sent by agent with a RedialReportMsg after it reconnects from a redial
+const RedialReport = "adslproxy-redial-report"
+
+// RedialAttempt is the result of a redial, Ip is empty if it is not checked
+type RedialAttempt struct {
+	Time       time.Time `json:"time"`
+	PreviousIp string    `json:"previous_ip"`
+	Ip         string    `json:"ip"`
+	Error      string    `json:"error,omitempty"`
+	// Duration is in milliseconds
+	Duration int64 `json:"duration"`
+}
+
+// RedialReportMsg describes a redial, the errors of the redialer are in the attempts
+type RedialReportMsg struct {
+	Reason     string `json:"reason"`
+	PreviousIp string `json:"previous_ip"`
+	Ip         string `json:"ip"`
+	// Offline is the milliseconds from the disconnection to the reconnection
+	Offline  int64           `json:"offline"`
+	Attempts []RedialAttempt `json:"attempts"`
+}
+
+const (
+	RedialReasonRequested = "requested by server"
+	RedialReasonLost      = "connection lost"
+	RedialReasonApi       = "requested by api"
+	// RedialReasonReported is the reason of a bad ip report which gives none
+	RedialReasonReported = "bad ip reported"
+)
+
+const IpEchoTimeout = 10 * time.Second
+
+const (
+	DefaultBackoffMin    = time.Second
+	DefaultBackoffMax    = 5 * time.Minute
+	DefaultBackoffJitter = 0.5
+)
+
+// FailbackInterval is how often the primary server is checked while agent is on another one
+const FailbackInterval = 30 * time.Second
+
+const DefaultEventLogSize = 1000
+
+const EventHookTimeout = 10 * time.Second
+
+// PortBindRetries is how many times an assigned port is bound again before it
+// is given up for the session, the port may not be released yet by the last one
+const PortBindRetries = 3
+
+const PortBindRetryInterval = 500 * time.Millisecond
+
+const DefaultCanaryInterval = 5 * time.Minute
+
+const CanaryTimeout = 15 * time.Second
+
 // Conn wraps a net.Conn, and sets a deadline for every read
 // and write operation.
 type Conn struct {
@@ -51,7 +144,11 @@ type Forward struct {
 
 	Options string
 
-	listener *net.TCPListener
+	// tunnelAddr is the addr that agent registered in the tunnel request, it
+	// differs from Left when the server listens on a held port
+	tunnelAddr *net.TCPAddr
+	// active is the number of connections through the forward, guarded by the lock of its node
+	active int
 }
 
 func (f *Forward) Format(s fmt.State, c rune) {
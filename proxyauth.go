@@ -0,0 +1,346 @@
+package adslproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	socks5Version          = 0x05
+	socks5AuthNone         = 0x00
+	socks5AuthUserPass     = 0x02
+	socks5AuthNoAcceptable = 0xff
+	// socks5UserPassVersion is the version of username/password authentication (RFC 1929)
+	socks5UserPassVersion = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+	// socks5RepNotAllowed is the reply of a request not allowed by ruleset
+	socks5RepNotAllowed = 0x02
+)
+
+const proxyAuthRequired = "HTTP/1.1 407 Proxy Authentication Required\r\n" +
+	"Proxy-Authenticate: Basic realm=\"Adslproxy\"\r\n" +
+	"Content-Length: 0\r\n" +
+	"Connection: close\r\n\r\n"
+
+// proxySession is a client connection authenticated by the server. The
+// handshake of the client is consumed by the server and replayed to the
+// proxy of agent without the credential.
+type proxySession struct {
+	Consumer *Consumer
+	// Target is the host requested by the http request or socks5
+	Target string
+
+	conn net.Conn
+	// reader of the client data which is not consumed by the handshake
+	reader io.Reader
+	replay func(agent io.ReadWriter) error
+	// replayable is false if the handshake can't be replayed more than once
+	replayable bool
+	// reject sends an error response of the proxy protocol to the client
+	reject func(reason string)
+}
+
+func (ps *proxySession) Read(b []byte) (int, error) {
+	return ps.reader.Read(b)
+}
+
+func (ps *proxySession) Write(b []byte) (int, error) {
+	return ps.conn.Write(b)
+}
+
+// requiresAuth reports whether clients of the forward are authenticated by the server
+func (s *Server) requiresAuth(name string) bool {
+	if s.Consumers == nil {
+		return false
+	}
+
+	for _, n := range s.AuthForwards {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authenticateProxy authenticates the client with either socks5 or http proxy protocol
+func (s *Server) authenticateProxy(conn net.Conn) (*proxySession, error) {
+	conn.SetDeadline(time.Now().Add(ProxyHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	br := bufio.NewReader(conn)
+	head, err := br.Peek(1)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var session *proxySession
+	if head[0] == socks5Version {
+		session, err = s.authenticateSocks5(conn, br)
+	} else {
+		session, err = s.authenticateHttp(conn, br)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Usage != nil {
+		if err := s.Usage.Acquire(session.Consumer); err != nil {
+			session.reject(err.Error())
+			return nil, err
+		}
+	}
+
+	return session, nil
+}
+
+func (s *Server) authenticateSocks5(conn net.Conn, br *bufio.Reader) (*proxySession, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if bytes.IndexByte(methods, socks5AuthUserPass) < 0 {
+		conn.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+		return nil, errors.New("username/password authentication is not supported by client")
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, socks5AuthUserPass}); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	readField := func() (string, error) {
+		size, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+
+		field := make([]byte, size)
+		_, err = io.ReadFull(br, field)
+		return string(field), err
+	}
+
+	version, err := br.ReadByte()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if version != socks5UserPassVersion {
+		return nil, errors.Errorf("unsupported version of username/password authentication %d", version)
+	}
+
+	username, err := readField()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	password, err := readField()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	consumer := s.Consumers.Authenticate(username, password)
+	if consumer == nil {
+		conn.Write([]byte{socks5UserPassVersion, 0x01})
+		return nil, errors.Errorf("authentication of %s failed", username)
+	}
+
+	if _, err := conn.Write([]byte{socks5UserPassVersion, 0x00}); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	request, err := readSocks5Request(br)
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxySession{
+		Consumer: consumer,
+		Target:   socks5Target(request),
+		conn:     conn,
+		reader:   br,
+		replay: func(agent io.ReadWriter) error {
+			return replaySocks5(agent, request)
+		},
+		replayable: true,
+		reject: func(reason string) {
+			conn.Write([]byte{socks5Version, socks5RepNotAllowed, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+		},
+	}, nil
+}
+
+// readSocks5Request reads the request following the authentication, it is
+// returned as is to be replayed to the agent
+func readSocks5Request(br *bufio.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var addrLen int
+	switch header[3] {
+	case socks5AtypIPv4:
+		addrLen = net.IPv4len
+	case socks5AtypIPv6:
+		addrLen = net.IPv6len
+	case socks5AtypDomain:
+		size, err := br.ReadByte()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		header = append(header, size)
+		addrLen = int(size)
+	default:
+		return nil, errors.Errorf("unknown address type of socks5 request %d", header[3])
+	}
+
+	// address and port
+	rest := make([]byte, addrLen+2)
+	if _, err := io.ReadFull(br, rest); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return append(header, rest...), nil
+}
+
+// socks5Target returns the host:port of a request read by readSocks5Request
+func socks5Target(request []byte) string {
+	var host string
+	addr := request[4 : len(request)-2]
+
+	switch request[3] {
+	case socks5AtypDomain:
+		host = string(addr[1:])
+	default:
+		host = net.IP(addr).String()
+	}
+
+	port := int(request[len(request)-2])<<8 | int(request[len(request)-1])
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// replaySocks5 negotiates no authentication with the socks5 proxy of agent and sends the request
+func replaySocks5(agent io.ReadWriter, request []byte) error {
+	if _, err := agent.Write([]byte{socks5Version, 1, socks5AuthNone}); err != nil {
+		return errors.WithStack(err)
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(agent, reply); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if reply[1] != socks5AuthNone {
+		return errors.Errorf("socks5 proxy of agent requires authentication method %d", reply[1])
+	}
+
+	_, err := agent.Write(request)
+	return errors.WithStack(err)
+}
+
+// discardReader drops everything read from the client, until it is closed
+type discardReader struct {
+	r io.Reader
+}
+
+func (d discardReader) Read(b []byte) (int, error) {
+	_, err := io.Copy(ioutil.Discard, d.r)
+	if err == nil {
+		err = io.EOF
+	}
+
+	return 0, err
+}
+
+// parseProxyAuthorization parses Basic credentials or a Bearer api key
+func parseProxyAuthorization(value string) (username, password string) {
+	parts := strings.SplitN(value, " ", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+
+	switch strings.ToLower(parts[0]) {
+	case "basic":
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return "", ""
+		}
+
+		credential := strings.SplitN(string(decoded), ":", 2)
+		if len(credential) != 2 {
+			return credential[0], ""
+		}
+
+		return credential[0], credential[1]
+	case "bearer":
+		return strings.TrimSpace(parts[1]), ""
+	}
+
+	return "", ""
+}
+
+func (s *Server) authenticateHttp(conn net.Conn, br *bufio.Reader) (*proxySession, error) {
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	consumer := s.Consumers.Authenticate(parseProxyAuthorization(req.Header.Get("Proxy-Authorization")))
+	if consumer == nil {
+		conn.Write([]byte(proxyAuthRequired))
+		return nil, errors.New("proxy authentication required")
+	}
+
+	req.Header.Del("Proxy-Authorization")
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// keeps WriteProxy from adding its default user agent
+		req.Header["User-Agent"] = []string{""}
+	}
+
+	// only the first request is authenticated, so a plain http connection is
+	// closed after its response and the later requests are dropped
+	var reader io.Reader = br
+	if req.Method != http.MethodConnect {
+		req.Close = true
+		reader = discardReader{br}
+	}
+
+	return &proxySession{
+		Consumer: consumer,
+		Target:   req.Host,
+		conn:     conn,
+		reader:   reader,
+		replay: func(agent io.ReadWriter) error {
+			return errors.WithStack(req.WriteProxy(agent))
+		},
+		// the body is read from the client while it is written
+		replayable: req.Body == http.NoBody,
+		reject: func(reason string) {
+			conn.Write([]byte(fmt.Sprintf(
+				"HTTP/1.1 429 Too Many Requests\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+				len(reason),
+				reason,
+			)))
+		},
+	}, nil
+}
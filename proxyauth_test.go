@@ -0,0 +1,167 @@
+package adslproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newAuthServer(t *testing.T) *Server {
+	consumers, err := NewConsumerStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	consumers.Put(&Consumer{Name: "alice", Password: "secret", ApiKeys: []string{"key-1"}})
+
+	s := newTestServer()
+	s.Consumers = consumers
+	return s
+}
+
+// authenticate runs the handshake of the client on one end of a pipe
+func authenticate(s *Server, client func(conn net.Conn)) (*proxySession, error) {
+	server, conn := net.Pipe()
+	defer conn.Close()
+
+	go client(conn)
+	return s.authenticateProxy(server)
+}
+
+func basicAuth(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+func TestAuthenticateHttp(t *testing.T) {
+	s := newAuthServer(t)
+
+	session, err := authenticate(s, func(conn net.Conn) {
+		io.WriteString(conn, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n"+
+			"Proxy-Authorization: "+basicAuth("alice", "secret")+"\r\n\r\n"+
+			"GET http://example.org/ HTTP/1.1\r\nHost: example.org\r\n\r\n")
+		conn.Close()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if session.Consumer.Name != "alice" || session.Target != "example.com" {
+		t.Errorf("session of %s to %s", session.Consumer.Name, session.Target)
+	}
+
+	var replayed bytes.Buffer
+	if err := session.replay(&replayed); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(&replayed))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if req.Header.Get("Proxy-Authorization") != "" || !req.Close {
+		t.Errorf("replayed request %v", req.Header)
+	}
+
+	// the second request on the connection is not authenticated and dropped
+	rest, _ := ioutil.ReadAll(session)
+	if len(rest) > 0 {
+		t.Errorf("%q is sent after the first request", rest)
+	}
+}
+
+func TestAuthenticateHttpConnect(t *testing.T) {
+	s := newAuthServer(t)
+
+	session, err := authenticate(s, func(conn net.Conn) {
+		io.WriteString(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n"+
+			"Proxy-Authorization: Bearer key-1\r\n\r\ntls data")
+		conn.Close()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if session.Target != "example.com:443" {
+		t.Errorf("target %s", session.Target)
+	}
+
+	// the tunnel data follows the request
+	rest, _ := ioutil.ReadAll(session)
+	if string(rest) != "tls data" {
+		t.Errorf("tunnel data %q", rest)
+	}
+}
+
+func TestAuthenticateHttpFailed(t *testing.T) {
+	s := newAuthServer(t)
+
+	reply := make(chan string, 1)
+	_, err := authenticate(s, func(conn net.Conn) {
+		io.WriteString(conn, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n"+
+			"Proxy-Authorization: "+basicAuth("alice", "wrong")+"\r\n\r\n")
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		reply <- line
+	})
+
+	if err == nil {
+		t.Fatal("wrong password is accepted")
+	}
+
+	if line := <-reply; !strings.Contains(line, "407") {
+		t.Errorf("reply %q", line)
+	}
+}
+
+func socks5Handshake(conn net.Conn, username, password string) []byte {
+	conn.Write([]byte{socks5Version, 1, socks5AuthUserPass})
+	reply := make([]byte, 2)
+	io.ReadFull(conn, reply)
+
+	auth := []byte{socks5UserPassVersion, byte(len(username))}
+	auth = append(auth, username...)
+	auth = append(auth, byte(len(password)))
+	auth = append(auth, password...)
+	conn.Write(auth)
+	io.ReadFull(conn, reply)
+
+	if reply[1] == 0 {
+		conn.Write([]byte{socks5Version, 1, 0, socks5AtypDomain, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0x01, 0xbb})
+	}
+
+	return reply
+}
+
+func TestAuthenticateSocks5(t *testing.T) {
+	s := newAuthServer(t)
+
+	session, err := authenticate(s, func(conn net.Conn) {
+		socks5Handshake(conn, "alice", "secret")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if session.Consumer.Name != "alice" || session.Target != "example.com:443" || !session.replayable {
+		t.Errorf("session of %s to %s", session.Consumer.Name, session.Target)
+	}
+
+	reply := make(chan []byte, 1)
+	if _, err := authenticate(s, func(conn net.Conn) {
+		reply <- socks5Handshake(conn, "alice", "wrong")
+	}); err == nil {
+		t.Error("wrong password is accepted")
+	}
+
+	if r := <-reply; r[1] == 0 {
+		t.Errorf("reply of wrong password %v", r)
+	}
+}
@@ -7,12 +7,14 @@ import (
 	"os/exec"
 	"regexp"
 	"runtime"
+	"sync"
 	"time"
 )
 
-func runWinCommand(to time.Duration, name string, arg ...string) ([]byte, error) {
-	ctx := context.Background()
-	ctx, _ = context.WithTimeout(ctx, to)
+func runCommand(to time.Duration, name string, arg ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), to)
+	defer cancel()
+
 	cmd := exec.CommandContext(ctx, name, arg...)
 	output, err := cmd.CombinedOutput()
 
@@ -22,7 +24,7 @@ func runWinCommand(to time.Duration, name string, arg ...string) ([]byte, error)
 const RASDIAL = "rasdial"
 
 func winConnect(to time.Duration, name, username, password string) error {
-	output, err := runWinCommand(to, RASDIAL, name, username, password)
+	output, err := runCommand(to, RASDIAL, name, username, password)
 	if err != nil {
 		return err
 	}
@@ -32,7 +34,7 @@ func winConnect(to time.Duration, name, username, password string) error {
 }
 
 func winDisconnect(to time.Duration, name string) error {
-	output, err := runWinCommand(to, RASDIAL, name, "/DISCONNECT")
+	output, err := runCommand(to, RASDIAL, name, "/DISCONNECT")
 	if err != nil {
 		return err
 	}
@@ -62,12 +64,8 @@ const DefaultPppoeStartScript = "/usr/sbin/pppoe-start"
 const DefaultPppoeStopScript = "/usr/sbin/pppoe-stop"
 
 func runBashScript(script, desc string) error {
-	cmd := exec.Command("/bin/bash", script)
-	if _, err := cmd.Output(); err != nil {
-		return err
-	} else {
-		return nil
-	}
+	glog.Infof("%s with %s", desc, script)
+	return runScript(DefaultScriptTimeout, nil, "/bin/bash", script)
 }
 
 func checkRoute() error {
@@ -103,14 +101,11 @@ func checkRoute() error {
 type CentosRedialer struct {
 }
 
-func (wr *CentosRedialer) Redial(_ *AdslConfig) error {
-	runBashScript(DefaultPppoeStopScript, "Stop pppoe")
-
-	if err := runBashScript(DefaultPppoeStartScript, "Start pppoe"); err != nil {
-		return err
-	}
-
-	return checkRoute()
+func (wr *CentosRedialer) Redial(c *AdslConfig) error {
+	return (&PppoeScriptsRedialer{
+		Start: DefaultPppoeStartScript,
+		Stop:  DefaultPppoeStopScript,
+	}).Redial(c)
 }
 
 type AdslConfig struct {
@@ -118,11 +113,39 @@ type AdslConfig struct {
 	Username      string
 	Password      string
 	InterfaceName string
+	// PreviousIp is the exit ip before the redial, which is got from IpEchoUrl.
+	// It is only written in RedialVerified, with redialLock held since the
+	// config is shared by the agents of the line.
+	PreviousIp string
+	// IpEchoUrl returns the exit ip as plain text, it is checked to be changed
+	// by a redial in at most MaxRedialAttempts. Not checked if empty.
+	IpEchoUrl         string
+	MaxRedialAttempts int
+	// VerifyTimeout is how long the line takes to come back after a redial
+	VerifyTimeout time.Duration
+	// CheckAddr is dialed to check the line when the session to server is
+	// closed, if IpEchoUrl is not set
+	CheckAddr string
+	// MinRedialInterval skips the redials requested by server without force
+	// within the interval since the last redial
+	MinRedialInterval time.Duration
 
 	RedialInterval time.Duration
+	// Redialer is selected by name with NewRedialer, it is chosen by os if nil
+	Redialer Redialer
+
+	// redialLock serializes the redials of the agents which share the line
+	redialLock sync.Mutex
+	lastRedial time.Time
+	// redialedBy is the id of the agent which did the last redial
+	redialedBy string
 }
 
 func (ac *AdslConfig) Redial() error {
+	if ac.Redialer != nil {
+		return ac.Redialer.Redial(ac)
+	}
+
 	switch runtime.GOOS {
 	case "windows":
 		return (&WindowsRedialer{}).Redial(ac)
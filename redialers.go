@@ -0,0 +1,204 @@
+package adslproxy
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RedialerFactory creates a redialer from its section of the redialer config,
+// the section is nil if it is absent. The config is validated here so that a
+// broken setup is found at startup rather than at the first redial.
+type RedialerFactory func(section json.RawMessage) (Redialer, error)
+
+var (
+	redialerLock sync.Mutex
+	redialers    = make(map[string]RedialerFactory)
+)
+
+// RegisterRedialer makes a redialer selectable by name
+func RegisterRedialer(name string, factory RedialerFactory) {
+	redialerLock.Lock()
+	defer redialerLock.Unlock()
+
+	redialers[name] = factory
+}
+
+func RedialerNames() []string {
+	redialerLock.Lock()
+	defer redialerLock.Unlock()
+
+	names := make([]string, 0, len(redialers))
+	for name := range redialers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// NewRedialer creates the redialer of the name. configPath is a json file
+// with a section by redialer name, e.g. {"pppd": {"peer": "dsl-provider"}},
+// and may be empty.
+func NewRedialer(name, configPath string) (Redialer, error) {
+	redialerLock.Lock()
+	factory, ok := redialers[name]
+	redialerLock.Unlock()
+
+	if !ok {
+		return nil, errors.Errorf("unknown redialer %s, one of %v", name, RedialerNames())
+	}
+
+	var sections map[string]json.RawMessage
+	if configPath != "" {
+		data, err := ioutil.ReadFile(configPath)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		if err := json.Unmarshal(data, &sections); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse redialer config %s", configPath)
+		}
+	}
+
+	r, err := factory(sections[name])
+	if err != nil {
+		return nil, errors.Wrapf(err, "illegal config of redialer %s", name)
+	}
+
+	return r, nil
+}
+
+// parseSection decodes the section into v, v keeps its defaults if the section is absent
+func parseSection(section json.RawMessage, v interface{}) error {
+	if len(section) == 0 {
+		return nil
+	}
+
+	return errors.WithStack(json.Unmarshal(section, v))
+}
+
+// lookPaths checks that the commands are executable
+func lookPaths(commands ...string) error {
+	for _, command := range commands {
+		if _, err := exec.LookPath(command); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+// NoopRedialer does nothing, the exit ip is changed by someone else
+type NoopRedialer struct {
+}
+
+func (nr *NoopRedialer) Redial(_ *AdslConfig) error {
+	return nil
+}
+
+// PppoeScriptsRedialer runs the start and stop scripts of rp-pppoe
+type PppoeScriptsRedialer struct {
+	Start string `json:"start"`
+	Stop  string `json:"stop"`
+}
+
+func (pr *PppoeScriptsRedialer) Redial(_ *AdslConfig) error {
+	runBashScript(pr.Stop, "Stop pppoe")
+
+	if err := runBashScript(pr.Start, "Start pppoe"); err != nil {
+		return err
+	}
+
+	return checkRoute()
+}
+
+// PppdRedialer brings a pppd peer down and up with poff and pon of Debian and Ubuntu
+type PppdRedialer struct {
+	Peer string `json:"peer"`
+	Pon  string `json:"pon"`
+	Poff string `json:"poff"`
+	// Timeout is in seconds
+	Timeout int `json:"timeout"`
+}
+
+func (pr *PppdRedialer) Redial(_ *AdslConfig) error {
+	timeout := time.Duration(pr.Timeout) * time.Second
+	runCommand(timeout, pr.Poff, pr.Peer)
+
+	if output, err := runCommand(timeout, pr.Pon, pr.Peer); err != nil {
+		return errors.Wrapf(err, "failed to bring up peer %s %s", pr.Peer, output)
+	}
+
+	// pon returns before the link is up
+	deadline := time.Now().Add(timeout)
+	for {
+		err := checkRoute()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+func init() {
+	RegisterRedialer("noop", func(section json.RawMessage) (Redialer, error) {
+		return &NoopRedialer{}, nil
+	})
+
+	RegisterRedialer("rasdial", func(section json.RawMessage) (Redialer, error) {
+		if err := lookPaths(RASDIAL); err != nil {
+			return nil, err
+		}
+
+		return &WindowsRedialer{}, nil
+	})
+
+	RegisterRedialer("pppoe-scripts", func(section json.RawMessage) (Redialer, error) {
+		r := &PppoeScriptsRedialer{
+			Start: DefaultPppoeStartScript,
+			Stop:  DefaultPppoeStopScript,
+		}
+
+		if err := parseSection(section, r); err != nil {
+			return nil, err
+		}
+
+		for _, script := range []string{r.Start, r.Stop} {
+			if _, err := os.Stat(script); err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+
+		return r, nil
+	})
+
+	RegisterRedialer("pppd", func(section json.RawMessage) (Redialer, error) {
+		r := &PppdRedialer{
+			Peer:    "provider",
+			Pon:     "pon",
+			Poff:    "poff",
+			Timeout: 30,
+		}
+
+		if err := parseSection(section, r); err != nil {
+			return nil, err
+		}
+
+		if r.Timeout <= 0 {
+			return nil, errors.Errorf("illegal timeout %d", r.Timeout)
+		}
+
+		if err := lookPaths(r.Pon, r.Poff); err != nil {
+			return nil, err
+		}
+
+		return r, nil
+	})
+}
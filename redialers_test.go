@@ -0,0 +1,86 @@
+package adslproxy
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRedialerNames(t *testing.T) {
+	names := strings.Join(RedialerNames(), ",")
+	if names != "http,nmcli,noop,pppd,pppoe-scripts,rasdial,script" {
+		t.Errorf("redialers %s", names)
+	}
+}
+
+func TestNewRedialer(t *testing.T) {
+	if r, err := NewRedialer("noop", ""); err != nil {
+		t.Error(err)
+	} else if _, ok := r.(*NoopRedialer); !ok {
+		t.Errorf("noop redialer is %T", r)
+	}
+
+	if _, err := NewRedialer("modem", ""); err == nil {
+		t.Error("unknown redialer is created")
+	}
+
+	if _, err := NewRedialer("noop", "/nonexistent/redialers.json"); err == nil {
+		t.Error("redialer is created without its config")
+	}
+
+	if _, err := NewRedialer("noop", writeTempFile(t, "redialers.json", "{")); err == nil {
+		t.Error("redialer is created with an illegal config")
+	}
+}
+
+func TestRedialerSections(t *testing.T) {
+	start := writeTempFile(t, "start", "")
+	stop := writeTempFile(t, "stop", "")
+	sections, _ := json.Marshal(map[string]interface{}{
+		"pppoe-scripts": map[string]string{"start": start, "stop": stop},
+		"pppd":          map[string]int{"timeout": 0},
+	})
+	config := writeTempFile(t, "redialers.json", string(sections))
+
+	r, err := NewRedialer("pppoe-scripts", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the section of another redialer is ignored
+	if pr := r.(*PppoeScriptsRedialer); pr.Start != start || pr.Stop != stop {
+		t.Errorf("pppoe scripts %+v", pr)
+	}
+
+	// redialers are validated at startup
+	for name, section := range map[string]string{
+		"pppoe-scripts": `{"start": "/nonexistent/pppoe-start"}`,
+		"pppd":          `{"timeout": 0}`,
+		"script":        `{}`,
+		"nmcli":         `{}`,
+	} {
+		config := writeTempFile(t, "redialers.json", `{"`+name+`": `+section+`}`)
+		if _, err := NewRedialer(name, config); err == nil {
+			t.Errorf("%s redialer is created with %s", name, section)
+		}
+	}
+}
+
+func TestParseSection(t *testing.T) {
+	r := &PppdRedialer{Peer: "provider", Timeout: 30}
+	if err := parseSection(nil, r); err != nil || r.Peer != "provider" {
+		t.Errorf("absent section %+v %v", r, err)
+	}
+
+	if err := parseSection(json.RawMessage(`{"peer": "dsl"}`), r); err != nil || r.Peer != "dsl" || r.Timeout != 30 {
+		t.Errorf("section %+v %v", r, err)
+	}
+}
+
+func TestRedialWithRedialer(t *testing.T) {
+	line := &fakeLine{}
+	config := &AdslConfig{Redialer: line}
+	if err := config.Redial(); err != nil || line.count() != 1 {
+		t.Errorf("%d redials %v", line.count(), err)
+	}
+}
@@ -0,0 +1,132 @@
+package adslproxy
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	// scoreRttScale is the heartbeat rtt which halves the rtt factor of a score
+	scoreRttScale = 500 * time.Millisecond
+	// scoreWarmup is how long a node takes after a redial to reach the full uptime factor
+	scoreWarmup = 2 * time.Minute
+	// minNodeScore keeps a flaky node selectable when no better one is free
+	minNodeScore = 0.01
+)
+
+// NodeScore is the weight of a node in selection from 0 to 1, with the inputs it is computed from
+type NodeScore struct {
+	Score float64 `json:"score"`
+	// Rtt is the round trip time of the last heartbeat in milliseconds
+	Rtt int64 `json:"rtt"`
+	// ProbeSuccess is the rate of canaries passed, 1 if no canary is checked
+	ProbeSuccess float64 `json:"probe_success"`
+	// Reports and DialErrors are counted in the report window
+	Reports    int `json:"reports"`
+	DialErrors int `json:"dial_errors"`
+	// Uptime is the seconds since the node is connected, i.e. since its last redial
+	Uptime int64 `json:"uptime"`
+}
+
+// countRecent returns the number of times in the window, must be called with the lock held
+func countRecent(times []time.Time, window time.Duration) int {
+	count := 0
+	since := time.Now().Add(-window)
+	for _, t := range times {
+		if t.After(since) {
+			count++
+		}
+	}
+
+	return count
+}
+
+// pruneRecent drops the times out of the window in place, must be called with the lock held
+func pruneRecent(times []time.Time, window time.Duration) []time.Time {
+	recent := times[:0]
+	since := time.Now().Add(-window)
+	for _, t := range times {
+		if t.After(since) {
+			recent = append(recent, t)
+		}
+	}
+
+	return recent
+}
+
+func (n *Node) setRtt(rtt time.Duration) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.rtt = rtt
+}
+
+// addDialError records a failure of a connection through the node
+func (n *Node) addDialError(window time.Duration) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.dialErrors = append(pruneRecent(n.dialErrors, window), time.Now())
+}
+
+// Score rates the node by its heartbeat rtt, canaries, bad ip reports and dial
+// errors in the window, and the time since its last redial
+func (n *Node) Score(window time.Duration) NodeScore {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	score := NodeScore{
+		Rtt:          int64(n.rtt / time.Millisecond),
+		ProbeSuccess: 1,
+		Reports:      countRecent(n.reports, window),
+		DialErrors:   countRecent(n.dialErrors, window),
+		Uptime:       int64(time.Since(n.connected) / time.Second),
+	}
+
+	if len(n.canaries) > 0 {
+		passed := 0
+		for _, r := range n.canaries {
+			if r.Ok {
+				passed++
+			}
+		}
+
+		score.ProbeSuccess = float64(passed) / float64(len(n.canaries))
+	}
+
+	warmup := 0.5 + 0.5*math.Min(1, float64(time.Since(n.connected))/float64(scoreWarmup))
+
+	score.Score = 1 / (1 + float64(n.rtt)/float64(scoreRttScale)) *
+		score.ProbeSuccess /
+		float64(1+score.Reports) /
+		float64(1+score.DialErrors) *
+		warmup
+
+	score.Score = math.Max(score.Score, minNodeScore)
+	return score
+}
+
+// weightedOrder shuffles the items so that one with a higher weight is more
+// likely to come first (Efraimidis-Spirakis sampling)
+func weightedOrder(count int, weight func(i int) float64, swap func(i, j int)) {
+	keys := make([]float64, count)
+	for i := range keys {
+		keys[i] = math.Pow(rand.Float64(), 1/weight(i))
+	}
+
+	sort.Sort(&keyedSwapper{keys, swap})
+}
+
+type keyedSwapper struct {
+	keys []float64
+	swap func(i, j int)
+}
+
+func (k *keyedSwapper) Len() int           { return len(k.keys) }
+func (k *keyedSwapper) Less(i, j int) bool { return k.keys[i] > k.keys[j] }
+func (k *keyedSwapper) Swap(i, j int) {
+	k.keys[i], k.keys[j] = k.keys[j], k.keys[i]
+	k.swap(i, j)
+}
@@ -0,0 +1,109 @@
+package adslproxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNodeScore(t *testing.T) {
+	good, _ := newTestNode("good")
+	good.connected = time.Now().Add(-time.Hour)
+
+	if score := good.Score(time.Minute); score.Score != 1 || score.ProbeSuccess != 1 {
+		t.Errorf("score of a good node %+v", score)
+	}
+
+	// a node which is just redialed is warming up
+	fresh, _ := newTestNode("fresh")
+	fresh.connected = time.Now()
+	if score := fresh.Score(time.Minute).Score; score < 0.49 || score > 0.51 {
+		t.Errorf("score of a fresh node %f", score)
+	}
+
+	slow, _ := newTestNode("slow")
+	slow.connected = good.connected
+	slow.setRtt(scoreRttScale)
+	if score := slow.Score(time.Minute).Score; score != 0.5 {
+		t.Errorf("score of a slow node %f", score)
+	}
+
+	flaky, _ := newTestNode("flaky")
+	flaky.connected = good.connected
+	flaky.addDialError(time.Minute)
+	flaky.addReport(time.Minute)
+	if score := flaky.Score(time.Minute); score.Score != 0.25 || score.DialErrors != 1 || score.Reports != 1 {
+		t.Errorf("score of a flaky node %+v", score)
+	}
+
+	// errors out of the window are not counted
+	if score := flaky.Score(0); score.Score != 1 {
+		t.Errorf("score with an empty window %+v", score)
+	}
+}
+
+func TestMinNodeScore(t *testing.T) {
+	node, _ := newTestNode("a")
+	for i := 0; i < 1000; i++ {
+		node.addDialError(time.Minute)
+	}
+
+	if score := node.Score(time.Minute).Score; score != minNodeScore {
+		t.Errorf("score %f", score)
+	}
+}
+
+func TestWeightedOrder(t *testing.T) {
+	weights := []float64{1, 9}
+	first := make([]int, 2)
+
+	for i := 0; i < 2000; i++ {
+		items := []int{0, 1}
+		weightedOrder(len(items), func(i int) float64 {
+			return weights[items[i]]
+		}, func(i, j int) {
+			items[i], items[j] = items[j], items[i]
+		})
+		first[items[0]]++
+	}
+
+	// the heavier item comes first about 9 times in 10
+	if first[1] < 1600 || first[1] > 1950 {
+		t.Errorf("heavier item is first %d times in 2000", first[1])
+	}
+}
+
+func TestPacProxies(t *testing.T) {
+	c := loadCanaries(t, `[{"url": "http://example.com/"}]`)[0]
+	s := newTestServer()
+	for i, id := range []string{"flaky", "good", "draining", "blocked"} {
+		node, f := newForwardNode(id, "http", nil)
+		node.connected = time.Now().Add(-time.Hour)
+		f.Left = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20000 + i}
+		s.Nodes.PushBack(node)
+
+		switch id {
+		case "flaky":
+			node.addDialError(time.Minute)
+		case "draining":
+			node.markDraining()
+		case "blocked":
+			node.setCanaryResult(c, CanaryResult{Canary: c.Name})
+		}
+	}
+	s.ReportWindow = time.Minute
+
+	// the blocked node is offered for other hosts, after the ones with better scores
+	proxies := s.PacProxies("http")
+	if len(proxies) != 3 || proxies[0].Port != 20001 || proxies[1].Port != 20000 {
+		t.Fatalf("pac proxies %+v", proxies)
+	}
+
+	if proxies[2].Port != 20003 || len(proxies[2].Blocked) != 1 || proxies[2].Blocked[0] != "example.com" {
+		t.Errorf("blocked node %+v", proxies[2])
+	}
+
+	if len(s.PacProxies("socks5")) != 0 {
+		t.Error("proxies of another forward are offered")
+	}
+}
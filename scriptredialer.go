@@ -0,0 +1,123 @@
+package adslproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const DefaultScriptTimeout = 60 * time.Second
+
+// ScriptResult may be printed by a redial script as the last line of its
+// stdout, it overrides the exit code of the script
+type ScriptResult struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error"`
+}
+
+// ScriptRedialer runs an executable to redial. The interface, the credentials
+// and the exit ip before the redial are passed in ADSL_INTERFACE,
+// ADSL_USERNAME, ADSL_PASSWORD and ADSL_PREVIOUS_IP.
+type ScriptRedialer struct {
+	Path string   `json:"path"`
+	Args []string `json:"args"`
+	// Timeout is in seconds
+	Timeout int `json:"timeout"`
+}
+
+func (sr *ScriptRedialer) Redial(c *AdslConfig) error {
+	env := []string{
+		"ADSL_INTERFACE=" + c.InterfaceName,
+		"ADSL_USERNAME=" + c.Username,
+		"ADSL_PASSWORD=" + c.Password,
+		"ADSL_PREVIOUS_IP=" + c.PreviousIp,
+	}
+
+	return runScript(time.Duration(sr.Timeout)*time.Second, env, sr.Path, sr.Args...)
+}
+
+// runScript runs the executable with the extra environment variables, and
+// kills it after the timeout. Its output is logged line by line.
+func runScript(timeout time.Duration, env []string, name string, arg ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, arg...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+
+	logOutput(name, "stdout", stdout.Bytes())
+	logOutput(name, "stderr", stderr.Bytes())
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return errors.Errorf("%s is killed after %s", name, timeout)
+	}
+
+	if result, ok := parseScriptResult(stdout.Bytes()); ok {
+		if !result.Ok {
+			return errors.Errorf("%s reported failure %s", name, result.Error)
+		}
+
+		return nil
+	}
+
+	return errors.Wrapf(err, "%s failed", name)
+}
+
+func logOutput(name, stream string, output []byte) {
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		glog.Infof("%s %s: %s", name, stream, scanner.Text())
+	}
+}
+
+// parseScriptResult reads a ScriptResult from the last non-empty line of the output
+func parseScriptResult(output []byte) (ScriptResult, bool) {
+	var result ScriptResult
+
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	last := strings.TrimSpace(lines[len(lines)-1])
+	if !strings.HasPrefix(last, "{") {
+		return result, false
+	}
+
+	if err := json.Unmarshal([]byte(last), &result); err != nil {
+		return result, false
+	}
+
+	return result, true
+}
+
+func init() {
+	RegisterRedialer("script", func(section json.RawMessage) (Redialer, error) {
+		r := &ScriptRedialer{Timeout: int(DefaultScriptTimeout / time.Second)}
+		if err := parseSection(section, r); err != nil {
+			return nil, err
+		}
+
+		if r.Path == "" {
+			return nil, errors.New("path of script is required")
+		}
+
+		if r.Timeout <= 0 {
+			return nil, errors.Errorf("illegal timeout %d", r.Timeout)
+		}
+
+		if err := lookPaths(r.Path); err != nil {
+			return nil, err
+		}
+
+		return r, nil
+	})
+}
@@ -0,0 +1,65 @@
+package adslproxy
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeScript(t *testing.T, content string) string {
+	path := writeTempFile(t, "redial.sh", "#!/bin/sh\n"+content)
+	if err := os.Chmod(path, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestScriptRedialer(t *testing.T) {
+	cases := []struct {
+		script string
+		ok     bool
+	}{
+		{"exit 0", true},
+		{"exit 1", false},
+		{`echo '{"ok": false, "error": "no carrier"}'`, false},
+		// the result overrides the exit code
+		{`echo '{"ok": true}'; exit 3`, true},
+		{`echo '{"ok": false, "error": "no carrier"}'; exit 0`, false},
+		{`test "$ADSL_INTERFACE" = ppp0 && test "$ADSL_PREVIOUS_IP" = 1.2.3.4`, true},
+	}
+
+	config := &AdslConfig{InterfaceName: "ppp0", PreviousIp: "1.2.3.4"}
+	for _, c := range cases {
+		r := &ScriptRedialer{Path: writeScript(t, c.script), Timeout: 5}
+		if err := r.Redial(config); (err == nil) != c.ok {
+			t.Errorf("%s: %v", c.script, err)
+		}
+	}
+}
+
+func TestScriptTimeout(t *testing.T) {
+	path := writeScript(t, "exec sleep 5")
+
+	start := time.Now()
+	err := runScript(100*time.Millisecond, nil, path)
+	if err == nil || !strings.Contains(err.Error(), "killed") {
+		t.Errorf("script is not killed %v", err)
+	}
+
+	if time.Since(start) > 3*time.Second {
+		t.Errorf("script is killed after %s", time.Since(start))
+	}
+}
+
+func TestParseScriptResult(t *testing.T) {
+	if _, ok := parseScriptResult([]byte("done\n")); ok {
+		t.Error("plain output is parsed as result")
+	}
+
+	result, ok := parseScriptResult([]byte("dialing\n{\"ok\": false, \"error\": \"busy\"}\n\n"))
+	if !ok || result.Ok || result.Error != "busy" {
+		t.Errorf("result %+v %v", result, ok)
+	}
+}
@@ -0,0 +1,151 @@
+package adslproxy
+
+import (
+	"encoding/json"
+	"github.com/gocloudio/crypto/ssh"
+	"testing"
+	"time"
+)
+
+func TestDrainWaitsForActiveConns(t *testing.T) {
+	node, conn := newTestNode("a")
+	f := &Forward{Name: "http"}
+	if !node.tryAcquire(f, 0, 0) {
+		t.Fatal("failed to acquire a slot")
+	}
+
+	done := make(chan bool)
+	go func() {
+		node.GracefulRedial(5*time.Second, ReconnectMsg{Reason: RedialReasonApi})
+		close(done)
+	}()
+
+	time.Sleep(2 * DrainCheckInterval)
+	if !node.IsDraining() {
+		t.Error("node is not draining")
+	}
+
+	if len(conn.sent(Reconnect)) != 0 {
+		t.Fatal("node is redialed with active connections")
+	}
+
+	node.release(f)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain is not finished after the connections are closed")
+	}
+
+	payloads := conn.sent(Reconnect)
+	if len(payloads) != 1 {
+		t.Fatalf("%d reconnect requests are sent", len(payloads))
+	}
+
+	var msg ReconnectMsg
+	if err := json.Unmarshal(payloads[0], &msg); err != nil || msg.Reason != RedialReasonApi {
+		t.Errorf("illegal reconnect request %s %v", payloads[0], err)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	node, conn := newTestNode("a")
+	f := &Forward{Name: "http"}
+	node.tryAcquire(f, 0, 0)
+
+	start := time.Now()
+	node.GracefulRedial(DrainCheckInterval, ReconnectMsg{})
+	if time.Since(start) > 3*DrainCheckInterval {
+		t.Errorf("drain takes %s over its timeout", time.Since(start))
+	}
+
+	if len(conn.sent(Reconnect)) != 1 || !conn.closed {
+		t.Error("node is not redialed after the drain timeout")
+	}
+}
+
+func TestDeclaredLabelsAreNotTrusted(t *testing.T) {
+	node, _ := newTestNode("a")
+	s := newTestServer(node)
+	s.NodeLabels = map[string][]string{"a": {"office"}}
+	node.setLabels(s.NodeLabels[node.Name])
+
+	reqs := make(chan *ssh.Request, 1)
+	reqs <- &ssh.Request{Type: NodeLabels, Payload: []byte(`["office", "admin"]`)}
+	close(reqs)
+	s.handleRequests(reqs, node)
+
+	if labels := node.Labels(); len(labels) != 1 || labels[0] != "office" {
+		t.Errorf("labels of node are %v", labels)
+	}
+}
+
+func TestConnLimits(t *testing.T) {
+	node, _ := newTestNode("a")
+	http := &Forward{Name: "http"}
+	socks := &Forward{Name: "socks5"}
+
+	if !node.tryAcquire(http, 2, 1) || node.tryAcquire(http, 2, 1) {
+		t.Error("forward limit is not applied")
+	}
+
+	if !node.tryAcquire(socks, 2, 1) {
+		t.Error("slot of another forward is not acquired")
+	}
+
+	if node.tryAcquire(socks, 2, 0) {
+		t.Error("node limit is not applied")
+	}
+
+	node.release(http)
+	if node.ActiveConns() != 1 || node.ForwardConns(http) != 0 {
+		t.Errorf("%d active conns after release", node.ActiveConns())
+	}
+}
+
+func TestQueueSlot(t *testing.T) {
+	node, _ := newTestNode("a")
+	f := &Forward{Name: "http"}
+
+	s := newTestServer(node)
+	s.MaxNodeConns = 1
+	s.ConnQueueTimeout = time.Second
+	node.tryAcquire(f, s.MaxNodeConns, 0)
+
+	// the connection waits for the slot released by another one
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		node.release(f)
+	}()
+
+	if !s.queueSlot(node, f) {
+		t.Fatal("queued connection doesn't get the released slot")
+	}
+
+	s.ConnQueueTimeout = 100 * time.Millisecond
+	start := time.Now()
+	if s.queueSlot(node, f) {
+		t.Error("slot over the limit is acquired")
+	}
+
+	if time.Since(start) > time.Second {
+		t.Errorf("queued connection is refused after %s", time.Since(start))
+	}
+}
+
+func TestRedialReportRequest(t *testing.T) {
+	node, _ := newTestNode("a")
+	s := newTestServer(node)
+
+	payload, _ := json.Marshal(RedialReportMsg{Reason: RedialReasonLost, PreviousIp: "198.51.100.1", Ip: "198.51.100.2"})
+	reqs := make(chan *ssh.Request, 2)
+	reqs <- &ssh.Request{Type: RedialReport, Payload: []byte("{")}
+	reqs <- &ssh.Request{Type: RedialReport, Payload: payload}
+	close(reqs)
+	s.handleRequests(reqs, node)
+
+	// the illegal report is skipped
+	redials := s.History.Redials("a")
+	if len(redials) != 1 || redials[0].Reason != RedialReasonLost || redials[0].Ip != "198.51.100.2" || redials[0].NodeName != node.Name {
+		t.Errorf("redials %+v", redials)
+	}
+}
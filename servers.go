@@ -0,0 +1,115 @@
+package adslproxy
+
+import (
+	"github.com/gocloudio/crypto/ssh"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ServerPolicyFailover connects to the first reachable server in order,
+	// and goes back to the primary when it recovers
+	ServerPolicyFailover = "failover"
+	// ServerPolicyWeighted picks a reachable server randomly by weight
+	ServerPolicyWeighted = "weighted"
+	// ServerPolicyAll registers the line with all servers, one agent per server
+	ServerPolicyAll = "all"
+)
+
+type ServerEndpoint struct {
+	// Addr is the host:port of server, the host is resolved when it is
+	// dialed, by the upstream proxy if there is one
+	Addr   string
+	Weight int
+}
+
+// ParseServerEndpoints parses comma separated addresses with optional
+// weights, e.g. "10.0.0.1:11222=3,10.0.0.2:11222"
+func ParseServerEndpoints(s string) ([]ServerEndpoint, error) {
+	var servers []ServerEndpoint
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		server := ServerEndpoint{Weight: 1}
+		if i := strings.LastIndex(item, "="); i >= 0 {
+			weight, err := strconv.Atoi(item[i+1:])
+			if err != nil || weight <= 0 {
+				return nil, errors.Errorf("illegal weight of server %s", item)
+			}
+
+			server.Weight = weight
+			item = item[:i]
+		}
+
+		_, port, err := net.SplitHostPort(item)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+			return nil, errors.Errorf("illegal port of server %s", item)
+		}
+
+		server.Addr = item
+		servers = append(servers, server)
+	}
+
+	if len(servers) == 0 {
+		return nil, errors.New("no server is given")
+	}
+
+	return servers, nil
+}
+
+// serverOrder returns the servers in the order they are tried
+func (a *Agent) serverOrder() []ServerEndpoint {
+	if len(a.Servers) == 0 {
+		return []ServerEndpoint{{Addr: a.serverAddr, Weight: 1}}
+	}
+
+	servers := append([]ServerEndpoint(nil), a.Servers...)
+	if a.ServerPolicy == ServerPolicyWeighted {
+		weightedOrder(len(servers), func(i int) float64 {
+			return float64(servers[i].Weight)
+		}, func(i, j int) {
+			servers[i], servers[j] = servers[j], servers[i]
+		})
+	}
+
+	return servers
+}
+
+// watchPrimary closes the session to a secondary server once the primary is
+// reachable again, so that the agent reconnects to the primary
+func (a *Agent) watchPrimary(client *ssh.Client, done chan bool) {
+	if a.ServerPolicy != ServerPolicyFailover || len(a.Servers) < 2 || a.serverAddr == a.Servers[0].Addr {
+		return
+	}
+
+	primary := a.Servers[0].Addr
+	ticker := time.NewTicker(FailbackInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			conn, err := a.dial(primary)
+			if err != nil {
+				continue
+			}
+
+			conn.Close()
+			glog.Infof("primary server %s is back, leave %s", primary, a.serverAddr)
+			client.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package adslproxy
+
+import (
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseServerEndpoints(t *testing.T) {
+	servers, err := ParseServerEndpoints("10.0.0.1:11222=3, 10.0.0.2:11222,")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(servers) != 2 || servers[0].Addr != "10.0.0.1:11222" || servers[0].Weight != 3 || servers[1].Weight != 1 {
+		t.Errorf("servers %+v", servers)
+	}
+
+	// the host is kept to be resolved on dialing, by the upstream proxy if there is one
+	servers, err = ParseServerEndpoints("server.invalid:11222")
+	if err != nil || servers[0].Addr != "server.invalid:11222" {
+		t.Errorf("servers %+v %v", servers, err)
+	}
+
+	for _, s := range []string{"", "10.0.0.1:11222=0", "10.0.0.1:11222=x", "10.0.0.1", "10.0.0.1:http"} {
+		if _, err := ParseServerEndpoints(s); err == nil {
+			t.Errorf("%q is parsed", s)
+		}
+	}
+}
+
+func TestServerOrder(t *testing.T) {
+	servers, _ := ParseServerEndpoints("10.0.0.1:11222,10.0.0.2:11222,10.0.0.3:11222")
+	a := &Agent{Servers: servers, ServerPolicy: ServerPolicyFailover}
+
+	for i, server := range a.serverOrder() {
+		if server.Addr != servers[i].Addr {
+			t.Errorf("failover order is changed %v", a.serverOrder())
+		}
+	}
+
+	// a server without weight is never first
+	servers[0].Weight = 0
+	a.ServerPolicy = ServerPolicyWeighted
+	for i := 0; i < 20; i++ {
+		if order := a.serverOrder(); len(order) != 3 || order[0].Addr == servers[0].Addr {
+			t.Fatalf("weighted order %v", order)
+		}
+	}
+}
+
+func TestSharedLineRedialedOnce(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	// the line is lost, and both agents sharing it lose their sessions
+	line := &fakeLine{delay: 100 * time.Millisecond}
+	config := &AdslConfig{CheckAddr: l.Addr().String(), Redialer: line}
+	first := &Agent{id: "first", adslConfig: config}
+	second := &Agent{id: "second", adslConfig: config}
+
+	done := make(chan bool)
+	go func() {
+		first.Reconnect()
+		close(done)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	if second.Reconnect() {
+		t.Error("line is redialed again by the second agent")
+	}
+	<-done
+
+	if line.count() != 1 {
+		t.Errorf("line is redialed %d times", line.count())
+	}
+
+	// a later loss is redialed by the agent which didn't redial the last time
+	if !second.Reconnect() || line.count() != 2 {
+		t.Errorf("lost line is not redialed, %d redials", line.count())
+	}
+}
+
+func TestSharedLinePreviousIp(t *testing.T) {
+	line := &fakeLine{ips: []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"}}
+	server := httptest.NewServer(line)
+	defer server.Close()
+
+	// both agents are asked to redial the line at once
+	config := newVerifiedConfig(line, server.URL)
+	var wg sync.WaitGroup
+	for _, id := range []string{"first", "second"} {
+		a := &Agent{id: id, adslConfig: config, reconnectRequest: &ReconnectMsg{Reason: RedialReasonApi, Force: true}}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.Reconnect()
+		}()
+	}
+	wg.Wait()
+
+	// the redials are serialized, each with the exit ip before it
+	if len(line.previousIps) != 2 || line.previousIps[0] != "1.1.1.1" || line.previousIps[1] != "2.2.2.2" {
+		t.Errorf("previous ips of redials %v", line.previousIps)
+	}
+}
+
+func TestUnreachableServerDoesNotRedial(t *testing.T) {
+	line := &fakeLine{}
+	a := &Agent{id: "a", adslConfig: &AdslConfig{Redialer: line}}
+
+	// without a check of the line, a server which can't be reached is not a lost line
+	if a.Reconnect() || line.count() != 0 {
+		t.Error("line is redialed for an unreachable server")
+	}
+}
@@ -0,0 +1,302 @@
+package adslproxy
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is in bytes per second, 0 for unlimited
+type RateLimit struct {
+	Up   int64 `json:"up"`
+	Down int64 `json:"down"`
+}
+
+const (
+	// ScopeLabel limits each node with the label
+	ScopeLabel = "label:"
+	// ScopeForward limits each forward with the name
+	ScopeForward = "forward:"
+	// ScopeConsumer limits all connections of the consumer
+	ScopeConsumer = "consumer:"
+)
+
+// throttleWaitStep is the max time to sleep for tokens, so that a changed rate is applied soon
+const throttleWaitStep = 100 * time.Millisecond
+
+// tokenBucket allows rate bytes per second with a burst of one second
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) setRate(rate int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.rate = rate
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+}
+
+// wait blocks until n bytes are allowed
+func (b *tokenBucket) wait(n int) {
+	for remaining := float64(n); remaining > 0; {
+		b.lock.Lock()
+		if b.rate <= 0 {
+			b.lock.Unlock()
+			return
+		}
+
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+		b.last = now
+		if b.tokens > float64(b.rate) {
+			b.tokens = float64(b.rate)
+		}
+
+		take := remaining
+		if take > float64(b.rate) {
+			take = float64(b.rate)
+		}
+
+		if b.tokens >= take {
+			b.tokens -= take
+			remaining -= take
+			b.lock.Unlock()
+			continue
+		}
+
+		sleep := time.Duration((take - b.tokens) / float64(b.rate) * float64(time.Second))
+		b.lock.Unlock()
+
+		if sleep > throttleWaitStep {
+			sleep = throttleWaitStep
+		}
+		time.Sleep(sleep)
+	}
+}
+
+type limitBuckets struct {
+	scope string
+	up    tokenBucket
+	down  tokenBucket
+}
+
+// Throttle holds the rate limits by scope, e.g. "consumer:alice", and the
+// token buckets shared by the connections limited by them. Limits changed
+// are applied to live connections.
+type Throttle struct {
+	lock    sync.Mutex
+	limits  map[string]RateLimit
+	buckets map[string]*limitBuckets
+}
+
+func NewThrottle() *Throttle {
+	return &Throttle{
+		limits:  make(map[string]RateLimit),
+		buckets: make(map[string]*limitBuckets),
+	}
+}
+
+// Set changes the limit of the scope
+func (t *Throttle) Set(scope string, limit RateLimit) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.limits[scope] = limit
+	for _, b := range t.buckets {
+		if b.scope == scope {
+			b.up.setRate(limit.Up)
+			b.down.setRate(limit.Down)
+		}
+	}
+}
+
+// Remove makes the scope unlimited
+func (t *Throttle) Remove(scope string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.limits, scope)
+	for key, b := range t.buckets {
+		if b.scope == scope {
+			b.up.setRate(0)
+			b.down.setRate(0)
+			delete(t.buckets, key)
+		}
+	}
+}
+
+// Replace sets all limits at once, scopes not in limits become unlimited
+func (t *Throttle) Replace(limits map[string]RateLimit) {
+	for scope := range t.Limits() {
+		if _, ok := limits[scope]; !ok {
+			t.Remove(scope)
+		}
+	}
+
+	for scope, limit := range limits {
+		t.Set(scope, limit)
+	}
+}
+
+func (t *Throttle) Limits() map[string]RateLimit {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	limits := make(map[string]RateLimit, len(t.limits))
+	for scope, limit := range t.limits {
+		limits[scope] = limit
+	}
+
+	return limits
+}
+
+// nodeLimits returns the limits of the scopes which apply to the node as a whole
+func (t *Throttle) nodeLimits(labels []string, forwards []*Forward) map[string]RateLimit {
+	limits := make(map[string]RateLimit)
+	for scope, limit := range t.Limits() {
+		for _, label := range labels {
+			if scope == ScopeLabel+label {
+				limits[scope] = limit
+			}
+		}
+
+		for _, f := range forwards {
+			if scope == ScopeForward+f.Name {
+				limits[scope] = limit
+			}
+		}
+	}
+
+	return limits
+}
+
+// labelScopes returns the limited label scopes, each with its own buckets.
+// On agent they are the scopes pushed by server for the labels of the node,
+// including the labels assigned by server.
+func (t *Throttle) labelScopes() [][2]string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var scopes [][2]string
+	for scope := range t.limits {
+		if strings.HasPrefix(scope, ScopeLabel) {
+			scopes = append(scopes, [2]string{scope, scope})
+		}
+	}
+
+	return scopes
+}
+
+// removeNode drops the buckets of the node, which are keyed with its id
+func (t *Throttle) removeNode(id string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for key := range t.buckets {
+		if strings.HasSuffix(key, "/"+id) {
+			delete(t.buckets, key)
+		}
+	}
+}
+
+// bucketsOf returns the buckets of the scope identified by key, key is
+// usually the scope with the id of the node. nil is returned if the scope is
+// not limited.
+func (t *Throttle) bucketsOf(scope, key string) *limitBuckets {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	limit, ok := t.limits[scope]
+	if !ok {
+		return nil
+	}
+
+	b, ok := t.buckets[key]
+	if !ok {
+		now := time.Now()
+		b = &limitBuckets{scope: scope}
+		b.up.rate, b.up.last = limit.Up, now
+		b.down.rate, b.down.last = limit.Down, now
+		t.buckets[key] = b
+	}
+
+	return b
+}
+
+// throttled limits the bytes read from (up) and written to (down) a client.
+// The buckets are looked up on every read and write, so that limits added
+// or removed later apply to the connection too.
+type throttled struct {
+	io.ReadWriter
+	throttle *Throttle
+	// scopes are pairs of scope and bucket key
+	scopes [][2]string
+}
+
+// wrap returns rw limited by the scopes, a scope is given with its bucket key
+func (t *Throttle) wrap(rw io.ReadWriter, scopes ...[2]string) io.ReadWriter {
+	if t == nil || len(scopes) == 0 {
+		return rw
+	}
+
+	return &throttled{
+		ReadWriter: rw,
+		throttle:   t,
+		scopes:     scopes,
+	}
+}
+
+func (tr *throttled) Read(p []byte) (int, error) {
+	n, err := tr.ReadWriter.Read(p)
+	for _, scope := range tr.scopes {
+		if b := tr.throttle.bucketsOf(scope[0], scope[1]); b != nil {
+			b.up.wait(n)
+		}
+	}
+
+	return n, err
+}
+
+func (tr *throttled) Write(p []byte) (int, error) {
+	for _, scope := range tr.scopes {
+		if b := tr.throttle.bucketsOf(scope[0], scope[1]); b != nil {
+			b.down.wait(len(p))
+		}
+	}
+
+	return tr.ReadWriter.Write(p)
+}
+
+// connScopes returns the scopes which limit a connection through the forward of the node
+func connScopes(node *Node, f *Forward, consumer *Consumer) [][2]string {
+	var scopes [][2]string
+	for _, label := range node.Labels() {
+		scopes = append(scopes, [2]string{ScopeLabel + label, ScopeLabel + label + "/" + node.Id})
+	}
+
+	scopes = append(scopes, [2]string{ScopeForward + f.Name, ScopeForward + f.Name + "/" + node.Id})
+
+	if consumer != nil {
+		scopes = append(scopes, [2]string{ScopeConsumer + consumer.Name, ScopeConsumer + consumer.Name})
+	}
+
+	return scopes
+}
+
+// pushLimits sends the limits of the node to its agent, which applies them
+// to its pipes as well
+func (s *Server) pushLimits(node *Node) {
+	payload, _ := json.Marshal(s.Throttle.nodeLimits(node.Labels(), node.ForwardList))
+	if _, _, err := node.conn.SendRequest(ThrottleLimits, false, payload); err != nil {
+		glog.Errorf("failed to push limits to %s %s", node, err)
+	}
+}
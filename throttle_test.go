@@ -0,0 +1,133 @@
+package adslproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestThrottleLimitsRate(t *testing.T) {
+	throttle := NewThrottle()
+	throttle.Set(ScopeConsumer+"alice", RateLimit{Down: 20000})
+
+	var client bytes.Buffer
+	rw := throttle.wrap(&client, [2]string{ScopeConsumer + "alice", ScopeConsumer + "alice"})
+
+	start := time.Now()
+	chunk := make([]byte, 1000)
+	for i := 0; i < 10; i++ {
+		rw.Write(chunk)
+	}
+
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("10000 bytes are written in %s at 20000 bytes/s", elapsed)
+	}
+
+	// a limit removed applies to the live connection
+	throttle.Remove(ScopeConsumer + "alice")
+	start = time.Now()
+	for i := 0; i < 100; i++ {
+		rw.Write(chunk)
+	}
+
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("unlimited connection is throttled for %s", elapsed)
+	}
+
+	if client.Len() != 110000 {
+		t.Errorf("%d bytes are written", client.Len())
+	}
+}
+
+func TestThrottleWrapUnlimited(t *testing.T) {
+	var client bytes.Buffer
+	var throttle *Throttle
+	if throttle.wrap(&client, [2]string{"forward:http", "forward:http/a"}) != &client {
+		t.Error("connection is wrapped without throttle")
+	}
+
+	if NewThrottle().wrap(&client) != &client {
+		t.Error("connection is wrapped without scopes")
+	}
+}
+
+func TestConnScopes(t *testing.T) {
+	node, _ := newTestNode("a")
+	node.setLabels([]string{"fast"})
+
+	scopes := connScopes(node, &Forward{Name: "http"}, &Consumer{Name: "alice"})
+	expected := [][2]string{
+		{"label:fast", "label:fast/a"},
+		{"forward:http", "forward:http/a"},
+		{"consumer:alice", "consumer:alice"},
+	}
+
+	if len(scopes) != len(expected) {
+		t.Fatalf("scopes %v", scopes)
+	}
+
+	for i := range expected {
+		if scopes[i] != expected[i] {
+			t.Errorf("scope %v, expected %v", scopes[i], expected[i])
+		}
+	}
+}
+
+func TestPushLimits(t *testing.T) {
+	node, conn := newTestNode("a")
+	node.setLabels([]string{"fast"})
+	node.ForwardList = []*Forward{{Name: "http"}}
+
+	s := newTestServer(node)
+	s.Throttle.Replace(map[string]RateLimit{
+		"label:fast":     {Up: 100},
+		"label:slow":     {Up: 10},
+		"forward:http":   {Down: 200},
+		"consumer:alice": {Down: 300},
+	})
+	s.pushLimits(node)
+
+	payloads := conn.sent(ThrottleLimits)
+	if len(payloads) != 1 {
+		t.Fatalf("%d limits are pushed", len(payloads))
+	}
+
+	// only the limits of the node as a whole are applied by agent
+	var limits map[string]RateLimit
+	json.Unmarshal(payloads[0], &limits)
+	if len(limits) != 2 || limits["label:fast"].Up != 100 || limits["forward:http"].Down != 200 {
+		t.Errorf("limits %v", limits)
+	}
+}
+
+func TestAgentLabelScopes(t *testing.T) {
+	// the agent declares no labels, the limit of a label assigned by server is pushed
+	a := NewAgent("demo", "token", "127.0.0.1:11222", nil, nil)
+	a.throttle.Replace(map[string]RateLimit{"label:office": {Up: 100}, "forward:http": {Down: 200}})
+
+	scopes := a.throttle.labelScopes()
+	if len(scopes) != 1 || scopes[0] != [2]string{"label:office", "label:office"} {
+		t.Errorf("label scopes %v", scopes)
+	}
+}
+
+func TestThrottleRemoveNode(t *testing.T) {
+	node, _ := newTestNode("a")
+	node.setLabels([]string{"fast"})
+	other, _ := newTestNode("b")
+
+	throttle := NewThrottle()
+	throttle.Set("label:fast", RateLimit{Up: 100})
+	throttle.Set("forward:http", RateLimit{Up: 100})
+	for _, n := range []*Node{node, other} {
+		for _, scope := range connScopes(n, &Forward{Name: "http"}, nil) {
+			throttle.bucketsOf(scope[0], scope[1])
+		}
+	}
+
+	throttle.removeNode("a")
+	if len(throttle.buckets) != 1 || throttle.buckets["forward:http/b"] == nil {
+		t.Errorf("buckets after the node is removed %v", throttle.buckets)
+	}
+}
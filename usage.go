@@ -0,0 +1,320 @@
+package adslproxy
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	dayLayout   = "2006-01-02"
+	monthLayout = "2006-01"
+)
+
+// Usage is the traffic of a consumer in a day or a month
+type Usage struct {
+	Consumer    string `json:"consumer"`
+	Period      string `json:"period"`
+	BytesUp     int64  `json:"bytes_up"`
+	BytesDown   int64  `json:"bytes_down"`
+	Connections int64  `json:"connections"`
+	// Requests is the number of CONNECT, socks5 and plain http requests sent to agents
+	Requests int64 `json:"requests"`
+}
+
+// usageKey is the key of the usage of the consumer in the period
+func usageKey(consumer, period string) string {
+	return consumer + "@" + period
+}
+
+func (u *Usage) bytes() int64 {
+	return u.BytesUp + u.BytesDown
+}
+
+// QuotaError is returned when a consumer exceeds one of its quotas
+type QuotaError struct {
+	Consumer string
+	Reason   string
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s of %s", e.Reason, e.Consumer)
+}
+
+// UsageTracker accounts the traffic of consumers and enforces their quotas.
+// If a path is given, the usages are saved to it every UsageSaveInterval.
+type UsageTracker struct {
+	path   string
+	lock   sync.Mutex
+	usages map[string]*Usage
+	active map[string]int
+}
+
+func NewUsageTracker(path string) (*UsageTracker, error) {
+	t := &UsageTracker{
+		path:   path,
+		usages: make(map[string]*Usage),
+		active: make(map[string]int),
+	}
+
+	if path == "" {
+		return t, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.WithStack(err)
+	}
+
+	if err == nil {
+		var usages []*Usage
+		if err := json.Unmarshal(data, &usages); err != nil {
+			return nil, errors.Wrapf(err, "failed to load usages from %s", path)
+		}
+
+		for _, u := range usages {
+			t.usages[usageKey(u.Consumer, u.Period)] = u
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(UsageSaveInterval)
+		for range ticker.C {
+			if err := t.Save(); err != nil {
+				glog.Errorf("failed to save usages %s", err)
+			}
+		}
+	}()
+
+	return t, nil
+}
+
+// usage returns the record of the consumer in the period, must be called with the lock held
+func (t *UsageTracker) usage(consumer, period string) *Usage {
+	key := usageKey(consumer, period)
+	u, ok := t.usages[key]
+	if !ok {
+		u = &Usage{Consumer: consumer, Period: period}
+		t.usages[key] = u
+	}
+
+	return u
+}
+
+// Acquire checks the quotas of the consumer before a new connection is proxied
+func (t *UsageTracker) Acquire(c *Consumer) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	daily := t.usage(c.Name, now.Format(dayLayout))
+	monthly := t.usage(c.Name, now.Format(monthLayout))
+
+	if c.MaxConns > 0 && t.active[c.Name] >= c.MaxConns {
+		return &QuotaError{c.Name, fmt.Sprintf("concurrent connection limit %d is reached", c.MaxConns)}
+	}
+
+	if c.DailyQuota > 0 && daily.bytes() >= c.DailyQuota {
+		return &QuotaError{c.Name, fmt.Sprintf("daily quota of %d bytes is exceeded", c.DailyQuota)}
+	}
+
+	if c.MonthlyQuota > 0 && monthly.bytes() >= c.MonthlyQuota {
+		return &QuotaError{c.Name, fmt.Sprintf("monthly quota of %d bytes is exceeded", c.MonthlyQuota)}
+	}
+
+	daily.Connections++
+	monthly.Connections++
+
+	t.active[c.Name]++
+	return nil
+}
+
+// Add accounts the traffic of a connection as it flows, an error is returned
+// once a quota of the consumer is exceeded
+func (t *UsageTracker) Add(c *Consumer, up, down int64) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	for _, u := range []*Usage{t.usage(c.Name, now.Format(dayLayout)), t.usage(c.Name, now.Format(monthLayout))} {
+		u.BytesUp += up
+		u.BytesDown += down
+	}
+
+	return t.exceeded(c)
+}
+
+// Exceeded returns an error if the traffic of the consumer is over a quota
+func (t *UsageTracker) Exceeded(c *Consumer) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.exceeded(c)
+}
+
+func (t *UsageTracker) exceeded(c *Consumer) error {
+	now := time.Now()
+	if c.DailyQuota > 0 && t.usage(c.Name, now.Format(dayLayout)).bytes() > c.DailyQuota {
+		return &QuotaError{c.Name, fmt.Sprintf("daily quota of %d bytes is exceeded", c.DailyQuota)}
+	}
+
+	if c.MonthlyQuota > 0 && t.usage(c.Name, now.Format(monthLayout)).bytes() > c.MonthlyQuota {
+		return &QuotaError{c.Name, fmt.Sprintf("monthly quota of %d bytes is exceeded", c.MonthlyQuota)}
+	}
+
+	return nil
+}
+
+// Request accounts a request of the consumer which is sent to an agent. A
+// plain http connection carries one request since the later ones are dropped.
+func (t *UsageTracker) Request(c *Consumer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	t.usage(c.Name, now.Format(dayLayout)).Requests++
+	t.usage(c.Name, now.Format(monthLayout)).Requests++
+}
+
+// Release is called when a connection acquired before is closed
+func (t *UsageTracker) Release(c *Consumer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.active[c.Name]--; t.active[c.Name] <= 0 {
+		delete(t.active, c.Name)
+	}
+}
+
+// wrap accounts the traffic of rw to the consumer, and fails its reads and
+// writes once a quota is exceeded so that the connection is closed
+func (t *UsageTracker) wrap(rw io.ReadWriter, c *Consumer) io.ReadWriter {
+	if t == nil || c == nil {
+		return rw
+	}
+
+	return &metered{ReadWriter: rw, tracker: t, consumer: c}
+}
+
+type metered struct {
+	io.ReadWriter
+	tracker  *UsageTracker
+	consumer *Consumer
+}
+
+func (m *metered) Read(b []byte) (int, error) {
+	n, err := m.ReadWriter.Read(b)
+	if n > 0 {
+		if quotaErr := m.tracker.Add(m.consumer, int64(n), 0); quotaErr != nil && err == nil {
+			err = quotaErr
+		}
+	}
+
+	return n, err
+}
+
+func (m *metered) Write(b []byte) (int, error) {
+	n, err := m.ReadWriter.Write(b)
+	if n > 0 {
+		if quotaErr := m.tracker.Add(m.consumer, 0, int64(n)); quotaErr != nil && err == nil {
+			err = quotaErr
+		}
+	}
+
+	return n, err
+}
+
+// List returns the usages of the consumer, or of all consumers if it is empty
+func (t *UsageTracker) List(consumer string) []Usage {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	list := make([]Usage, 0, len(t.usages))
+	for _, u := range t.usages {
+		if consumer == "" || u.Consumer == consumer {
+			list = append(list, *u)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Consumer != list[j].Consumer {
+			return list[i].Consumer < list[j].Consumer
+		}
+
+		return list[i].Period < list[j].Period
+	})
+
+	return list
+}
+
+// WriteUsageCsv writes the usages as csv with a header line
+func WriteUsageCsv(w io.Writer, usages []Usage) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"consumer", "period", "bytes_up", "bytes_down", "connections", "requests"})
+
+	for _, u := range usages {
+		cw.Write([]string{
+			u.Consumer,
+			u.Period,
+			strconv.FormatInt(u.BytesUp, 10),
+			strconv.FormatInt(u.BytesDown, 10),
+			strconv.FormatInt(u.Connections, 10),
+			strconv.FormatInt(u.Requests, 10),
+		})
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func (t *UsageTracker) Save() error {
+	if t.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(t.List(""), "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	tmp := t.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(os.Rename(tmp, t.path))
+}
+
+// meter counts the bytes read from and written to a client
+type meter struct {
+	io.ReadWriter
+	read    int64
+	written int64
+}
+
+func (m *meter) Read(b []byte) (int, error) {
+	n, err := m.ReadWriter.Read(b)
+	atomic.AddInt64(&m.read, int64(n))
+	return n, err
+}
+
+func (m *meter) Write(b []byte) (int, error) {
+	n, err := m.ReadWriter.Write(b)
+	atomic.AddInt64(&m.written, int64(n))
+	return n, err
+}
+
+// counts returns the bytes read from and written to the client
+func (m *meter) counts() (read, written int64) {
+	return atomic.LoadInt64(&m.read), atomic.LoadInt64(&m.written)
+}
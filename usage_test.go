@@ -0,0 +1,154 @@
+package adslproxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsageQuota(t *testing.T) {
+	tracker, err := NewUsageTracker("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Consumer{Name: "alice", DailyQuota: 100, MaxConns: 1}
+	if err := tracker.Acquire(c); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tracker.Acquire(c); err == nil {
+		t.Error("connections over MaxConns are acquired")
+	}
+
+	if err := tracker.Add(c, 60, 40); err != nil {
+		t.Errorf("traffic within quota fails %s", err)
+	}
+
+	if err := tracker.Add(c, 1, 0); err == nil {
+		t.Error("traffic over quota is accepted")
+	}
+
+	tracker.Release(c)
+	if err := tracker.Acquire(c); err == nil {
+		t.Error("connection over quota is acquired")
+	}
+
+	usages := tracker.List("alice")
+	if len(usages) != 2 || usages[0].BytesUp != 61 || usages[0].BytesDown != 40 || usages[0].Connections != 1 {
+		t.Errorf("usages %+v", usages)
+	}
+}
+
+func TestUsageCutsLongConnection(t *testing.T) {
+	tracker, _ := NewUsageTracker("")
+	c := &Consumer{Name: "alice", DailyQuota: 1000}
+
+	// a long tunnel is cut as soon as it is over the quota, not when it is closed
+	client := &bytes.Buffer{}
+	client.WriteString(strings.Repeat("x", 10000))
+	rw := tracker.wrap(client, c)
+
+	read := 0
+	b := make([]byte, 100)
+	for {
+		n, err := rw.Read(b)
+		read += n
+		if err != nil {
+			if _, ok := err.(*QuotaError); !ok {
+				t.Fatalf("unexpected error %v", err)
+			}
+			break
+		}
+	}
+
+	if read > 1100 {
+		t.Errorf("%d bytes are read over the quota", read)
+	}
+
+	if _, err := rw.Write([]byte("y")); err == nil {
+		t.Error("write over quota succeeds")
+	}
+
+	if tracker.Exceeded(c) == nil {
+		t.Error("consumer is not over quota")
+	}
+
+	if tracker.wrap(client, nil) != client {
+		t.Error("connection without consumer is metered")
+	}
+}
+
+func TestUsageSavedOnStop(t *testing.T) {
+	path := filepath.Join(filepath.Dir(writeTempFile(t, "empty", "")), "usage.json")
+	tracker, err := NewUsageTracker(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Consumer{Name: "alice"}
+	tracker.Acquire(c)
+	tracker.Add(c, 10, 20)
+
+	s := newTestServer()
+	s.Usage = tracker
+	s.Stop()
+
+	loaded, err := NewUsageTracker(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usages := loaded.List("alice")
+	if len(usages) != 2 || usages[0].BytesUp != 10 || usages[0].BytesDown != 20 {
+		t.Errorf("usages after restart %+v", usages)
+	}
+}
+
+func TestWriteUsageCsv(t *testing.T) {
+	var buf bytes.Buffer
+	WriteUsageCsv(&buf, []Usage{{Consumer: "alice", Period: "2020-01", BytesUp: 1, BytesDown: 2, Connections: 3, Requests: 4}})
+
+	expected := "consumer,period,bytes_up,bytes_down,connections,requests\nalice,2020-01,1,2,3,4\n"
+	if buf.String() != expected {
+		t.Errorf("csv %q", buf.String())
+	}
+}
+
+func TestUsageCountsRequests(t *testing.T) {
+	s := newAuthServer(t)
+	s.AuthForwards = []string{"http"}
+	s.Usage, _ = NewUsageTracker("")
+
+	_, f := newBoundNode(t, s, "a", "http", serveProxy(map[string]string{
+		"example.com": "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n",
+	}))
+
+	request := func(auth string) {
+		conn, err := net.Dial("tcp", f.Left.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n"+
+			"Proxy-Authorization: "+auth+"\r\n\r\n")
+		ioutil.ReadAll(conn)
+	}
+
+	request(basicAuth("alice", "secret"))
+	request(basicAuth("alice", "wrong"))
+	request("Bearer key-1")
+
+	// the request refused by authentication is not counted
+	usages := s.Usage.List("alice")
+	if len(usages) != 2 || usages[0].Requests != 2 || usages[1].Requests != 2 {
+		t.Errorf("usages %+v", usages)
+	}
+}